@@ -20,9 +20,13 @@ type ServerConfig struct {
 	Address string `mapstructure:"address"`
 }
 
+// KubernetesConfig sets how resources are watched. Endpoints are discovered
+// from EndpointSlices instead of Endpoints when EndpointSlices is enabled,
+// which requires Kubernetes 1.21 or later.
 type KubernetesConfig struct {
-	Namespace    string        `mapstructure:"namespace"`
-	ResyncPeriod time.Duration `mapstructure:"resyncPeriod"`
+	Namespace      string        `mapstructure:"namespace"`
+	ResyncPeriod   time.Duration `mapstructure:"resyncPeriod"`
+	EndpointSlices bool          `mapstructure:"endpointSlices"`
 }
 
 type LogConfig struct {
@@ -31,7 +35,106 @@ type LogConfig struct {
 }
 
 type EnvoyConfig struct {
-	Node string `mapstructure:"node"`
+	Node            string                `mapstructure:"node"`
+	DNSLookupFamily string                `mapstructure:"dnsLookupFamily"`
+	Listener        ListenerConfig        `mapstructure:"listener"`
+	CircuitBreakers CircuitBreakersConfig `mapstructure:"circuitBreakers"`
+	Headers         HeadersConfig         `mapstructure:"headers"`
+	Gzip            GzipConfig            `mapstructure:"gzip"`
+	Upgrade         UpgradeConfig         `mapstructure:"upgrade"`
+	TCPProxy        TCPProxyConfig        `mapstructure:"tcpProxy"`
+	Locality        LocalityConfig        `mapstructure:"locality"`
+	Draining        DrainingConfig        `mapstructure:"draining"`
+	Weights         WeightsConfig         `mapstructure:"weights"`
+	Subsets         SubsetsConfig         `mapstructure:"subsets"`
+}
+
+// ListenerConfig sets listeners. Listeners accept both IPv4 and IPv6
+// connections when DualStack is enabled.
+type ListenerConfig struct {
+	DualStack bool `mapstructure:"dualStack"`
+}
+
+type CircuitBreakersConfig struct {
+	Default CircuitBreakerThresholds `mapstructure:"default"`
+	High    CircuitBreakerThresholds `mapstructure:"high"`
+}
+
+// CircuitBreakerThresholds sets the default circuit breaker thresholds of
+// a routing priority. Zero values fall back to Envoy defaults.
+type CircuitBreakerThresholds struct {
+	MaxConnections     uint32 `mapstructure:"maxConnections"`
+	MaxPendingRequests uint32 `mapstructure:"maxPendingRequests"`
+	MaxRequests        uint32 `mapstructure:"maxRequests"`
+	MaxRetries         uint32 `mapstructure:"maxRetries"`
+}
+
+// HeadersConfig sets headers manipulated on all routes. Headers to add are in
+// the form of "<name>: <value>", one header per line, the same as annotations.
+// Headers to remove are separated by commas.
+type HeadersConfig struct {
+	RequestHeadersToAdd     string   `mapstructure:"requestHeadersToAdd"`
+	RequestHeadersToRemove  []string `mapstructure:"requestHeadersToRemove"`
+	ResponseHeadersToAdd    string   `mapstructure:"responseHeadersToAdd"`
+	ResponseHeadersToRemove []string `mapstructure:"responseHeadersToRemove"`
+}
+
+// GzipConfig sets the gzip filter. Services can override Enabled with
+// annotations. The filter is shared by all services once any service enables
+// it, so services have to opt out explicitly to keep responses uncompressed.
+type GzipConfig struct {
+	Enabled          bool     `mapstructure:"enabled"`
+	ContentTypes     []string `mapstructure:"contentTypes"`
+	MinContentLength uint32   `mapstructure:"minContentLength"`
+	CompressionLevel string   `mapstructure:"compressionLevel"`
+}
+
+// UpgradeConfig sets HTTP upgrades (e.g. websocket) enabled on all routes.
+// IdleTimeout is used by routes with upgrades unless they have their own
+// idle timeout.
+type UpgradeConfig struct {
+	Types       []string      `mapstructure:"types"`
+	IdleTimeout time.Duration `mapstructure:"idleTimeout"`
+}
+
+// TCPProxyConfig sets TCP proxy listeners. Services can override IdleTimeout
+// with annotations. Access logs are disabled when AccessLogPath is empty.
+type TCPProxyConfig struct {
+	IdleTimeout   time.Duration `mapstructure:"idleTimeout"`
+	AccessLogPath string        `mapstructure:"accessLogPath"`
+}
+
+// LocalityConfig sets locality-aware load balancing. When enabled, endpoints
+// are grouped by zones and regions of their nodes. LocalCluster is the service
+// Envoys belong to, and it must be the local_cluster_name in the bootstrap
+// config of Envoys for zone-aware routing.
+type LocalityConfig struct {
+	Enabled      bool   `mapstructure:"enabled"`
+	LocalCluster string `mapstructure:"localCluster"`
+}
+
+// DrainingConfig sets how long removed and not ready endpoints are kept as
+// draining or unhealthy. Endpoints are removed immediately when GracePeriod is
+// zero.
+type DrainingConfig struct {
+	GracePeriod time.Duration `mapstructure:"gracePeriod"`
+}
+
+// WeightsConfig sets endpoint weights read from annotations of pods.
+// DefaultWeight is used by pods without annotations. When SlowStartWindow is
+// set, weights of pods increase linearly in the window after pods become
+// ready, so DefaultWeight should be larger than 1.
+type WeightsConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	DefaultWeight   uint32        `mapstructure:"defaultWeight"`
+	SlowStartWindow time.Duration `mapstructure:"slowStartWindow"`
+}
+
+// SubsetsConfig sets subset load balancing. When enabled, labels of pods are
+// attached to endpoints of services with subset annotations. Subset
+// annotations are ignored when it's disabled.
+type SubsetsConfig struct {
+	Enabled bool `mapstructure:"enabled"`
 }
 
 func ReadConfig() (*Config, error) {
@@ -0,0 +1,107 @@
+package envoy
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/gogo/protobuf/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	ErrInvalidAnnotation = merry.New("invalid annotation value")
+)
+
+func newAnnotationError(svc *corev1.Service, key string) merry.Error {
+	return ErrInvalidAnnotation.Here().
+		WithValue("service", svc.Name).
+		WithValue("annotation", key).
+		WithValue("value", svc.Annotations[key])
+}
+
+func getDurationAnnotation(svc *corev1.Service, key string) (*time.Duration, error) {
+	s, ok := svc.Annotations[key]
+
+	if !ok {
+		return nil, nil
+	}
+
+	d, err := time.ParseDuration(s)
+
+	if err != nil {
+		return nil, newAnnotationError(svc, key).Append(err.Error())
+	}
+
+	if d < 0 {
+		return nil, newAnnotationError(svc, key).Append("duration must not be negative")
+	}
+
+	return &d, nil
+}
+
+func getUint32Annotation(svc *corev1.Service, key string) (*types.UInt32Value, error) {
+	s, ok := svc.Annotations[key]
+
+	if !ok {
+		return nil, nil
+	}
+
+	v, err := strconv.ParseUint(s, 10, 32)
+
+	if err != nil {
+		return nil, newAnnotationError(svc, key).Append(err.Error())
+	}
+
+	return &types.UInt32Value{Value: uint32(v)}, nil
+}
+
+func getPercentAnnotation(svc *corev1.Service, key string) (*types.UInt32Value, error) {
+	v, err := getUint32Annotation(svc, key)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if v != nil && v.Value > 100 {
+		return nil, newAnnotationError(svc, key).Append("percentage must be between 0 and 100")
+	}
+
+	return v, nil
+}
+
+func getListAnnotation(svc *corev1.Service, key string) []string {
+	return splitList(svc.Annotations[key])
+}
+
+// splitList splits a comma-separated list and drops empty values.
+func splitList(s string) []string {
+	var result []string
+
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+// getLinesAnnotation splits an annotation by lines and drops empty lines. It
+// is used by values which may contain commas, such as regular expressions.
+func getLinesAnnotation(svc *corev1.Service, key string) []string {
+	var result []string
+
+	for _, line := range strings.Split(svc.Annotations[key], "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			result = append(result, line)
+		}
+	}
+
+	return result
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
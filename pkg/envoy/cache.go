@@ -12,15 +12,16 @@ import (
 type Cache struct {
 	envoycache.SnapshotCache
 
-	mutex       sync.RWMutex
-	lastVersion string
+	mutex        sync.RWMutex
+	lastVersions map[string]string
 }
 
-func NewCache(ctx context.Context) *Cache {
+func NewCache(ctx context.Context, hash NodeHash) *Cache {
 	logger := zerolog.Ctx(ctx)
 
 	return &Cache{
-		SnapshotCache: envoycache.NewSnapshotCache(true, NodeHash{}, NewLogger(logger)),
+		SnapshotCache: envoycache.NewSnapshotCache(true, hash, NewLogger(logger)),
+		lastVersions:  map[string]string{},
 	}
 }
 
@@ -32,13 +33,13 @@ func (c *Cache) UpdateSnapshot(node string, version string, snapshot envoycache.
 		return merry.Wrap(err)
 	}
 
-	c.lastVersion = version
+	c.lastVersions[node] = version
 	return nil
 }
 
-func (c *Cache) ShouldUpdate(version string) bool {
+func (c *Cache) ShouldUpdate(node string, version string) bool {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
-	return c.lastVersion != version
+	return c.lastVersions[node] != version
 }
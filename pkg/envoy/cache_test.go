@@ -12,15 +12,19 @@ import (
 
 var _ = Describe("Cache", func() {
 	Describe("ShouldUpdate", func() {
-		cache := NewCache(context.Background())
-		cache.lastVersion = "1"
+		cache := NewCache(context.Background(), NodeHash{})
+		cache.lastVersions["test-node"] = "1"
 
 		It("should return true when version changed", func() {
-			Expect(cache.ShouldUpdate("2")).To(BeTrue())
+			Expect(cache.ShouldUpdate("test-node", "2")).To(BeTrue())
 		})
 
 		It("should return false when version unchanged", func() {
-			Expect(cache.ShouldUpdate("1")).To(BeFalse())
+			Expect(cache.ShouldUpdate("test-node", "1")).To(BeFalse())
+		})
+
+		It("should return true for new nodes", func() {
+			Expect(cache.ShouldUpdate("other-node", "1")).To(BeTrue())
 		})
 	})
 
@@ -30,14 +34,14 @@ var _ = Describe("Cache", func() {
 		version := "test"
 
 		BeforeEach(func() {
-			c = NewCache(context.Background())
+			c = NewCache(context.Background(), NodeHash{})
 			Expect(c.UpdateSnapshot(node, version, cache.Snapshot{
 				Listeners: cache.Resources{Version: version},
 			})).NotTo(HaveOccurred())
 		})
 
 		It("should update version", func() {
-			Expect(c.lastVersion).To(Equal(version))
+			Expect(c.lastVersions[node]).To(Equal(version))
 		})
 
 		It("should update snapshot", func() {
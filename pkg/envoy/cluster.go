@@ -0,0 +1,273 @@
+package envoy
+
+import (
+	"strconv"
+
+	"github.com/ansel1/merry"
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/gogo/protobuf/types"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func newCluster(name string, svc *corev1.Service, conf *config.EnvoyConfig) (*api.Cluster, error) {
+	c := &api.Cluster{
+		Name:           name,
+		ConnectTimeout: DefaultConnectTimeout,
+		Type:           api.Cluster_EDS,
+		EdsClusterConfig: &api.Cluster_EdsClusterConfig{
+			EdsConfig: &core.ConfigSource{
+				ConfigSourceSpecifier: &core.ConfigSource_Ads{
+					Ads: &core.AggregatedConfigSource{},
+				},
+			},
+		},
+	}
+
+	timeout, err := getDurationAnnotation(svc, AnnotationConnectTimeout)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if timeout != nil {
+		c.ConnectTimeout = *timeout
+	}
+
+	if c.DnsLookupFamily, err = getDNSLookupFamily(svc, conf); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	c.LbPolicy = getLbPolicy(svc)
+	ringHash, err := newRingHashLbConfig(svc)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if ringHash != nil && c.LbPolicy == api.Cluster_RING_HASH {
+		c.LbConfig = &api.Cluster_RingHashLbConfig_{RingHashLbConfig: ringHash}
+	}
+
+	zoneAware, err := newZoneAwareLbConfig(svc)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if zoneAware != nil {
+		c.CommonLbConfig = &api.Cluster_CommonLbConfig{
+			LocalityConfigSpecifier: &api.Cluster_CommonLbConfig_ZoneAwareLbConfig_{
+				ZoneAwareLbConfig: zoneAware,
+			},
+		}
+	}
+
+	if c.CircuitBreakers, err = newCircuitBreakers(svc, &conf.CircuitBreakers); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if c.OutlierDetection, err = newOutlierDetection(svc); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if err = setHealthChecks(svc, c); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	return c, nil
+}
+
+// getDNSLookupFamily returns the DNS lookup family set in annotations or the
+// config. IPv4 is used by default.
+func getDNSLookupFamily(svc *corev1.Service, conf *config.EnvoyConfig) (api.Cluster_DnsLookupFamily, error) {
+	s, ok := svc.Annotations[AnnotationDNSLookupFamily]
+
+	if !ok {
+		s = conf.DNSLookupFamily
+	}
+
+	if s == "" {
+		return api.Cluster_V4_ONLY, nil
+	}
+
+	v, ok := api.Cluster_DnsLookupFamily_value[s]
+
+	if !ok {
+		return 0, ErrInvalidDNSLookupFamily.Here().
+			WithValue("service", svc.Name).
+			WithValue("value", s)
+	}
+
+	return api.Cluster_DnsLookupFamily(v), nil
+}
+
+// getLbPolicy returns the load balancer policy set in annotations. Services
+// with client IP session affinity use ring hash by default, so requests from
+// the same client are sent to the same endpoint.
+func getLbPolicy(svc *corev1.Service) api.Cluster_LbPolicy {
+	if s, ok := svc.Annotations[AnnotationLbPolicy]; ok {
+		if v, ok := api.Cluster_LbPolicy_value[s]; ok {
+			return api.Cluster_LbPolicy(v)
+		}
+	}
+
+	if svc.Spec.SessionAffinity == corev1.ServiceAffinityClientIP {
+		return api.Cluster_RING_HASH
+	}
+
+	return api.Cluster_ROUND_ROBIN
+}
+
+func newRingHashLbConfig(svc *corev1.Service) (*api.Cluster_RingHashLbConfig, error) {
+	s, ok := svc.Annotations[AnnotationMinimumRingSize]
+
+	if !ok {
+		return nil, nil
+	}
+
+	size, err := strconv.ParseUint(s, 10, 64)
+
+	if err != nil {
+		return nil, newAnnotationError(svc, AnnotationMinimumRingSize).Append(err.Error())
+	}
+
+	return &api.Cluster_RingHashLbConfig{
+		MinimumRingSize: &types.UInt64Value{Value: size},
+	}, nil
+}
+
+func newCircuitBreakers(svc *corev1.Service, conf *config.CircuitBreakersConfig) (*cluster.CircuitBreakers, error) {
+	var thresholds []*cluster.CircuitBreakers_Thresholds
+
+	priorities := []struct {
+		priority core.RoutingPriority
+		keys     [4]string
+		defaults *config.CircuitBreakerThresholds
+	}{
+		{
+			priority: core.RoutingPriority_DEFAULT,
+			keys: [4]string{
+				AnnotationMaxConnections,
+				AnnotationMaxPendingRequests,
+				AnnotationMaxRequests,
+				AnnotationMaxRetries,
+			},
+			defaults: &conf.Default,
+		},
+		{
+			priority: core.RoutingPriority_HIGH,
+			keys: [4]string{
+				AnnotationHighPriorityMaxConnections,
+				AnnotationHighPriorityMaxPendingRequests,
+				AnnotationHighPriorityMaxRequests,
+				AnnotationHighPriorityMaxRetries,
+			},
+			defaults: &conf.High,
+		},
+	}
+
+	for _, p := range priorities {
+		t, err := newCircuitBreakerThresholds(svc, p.keys, p.defaults)
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		if t != nil {
+			t.Priority = p.priority
+			thresholds = append(thresholds, t)
+		}
+	}
+
+	if len(thresholds) == 0 {
+		return nil, nil
+	}
+
+	return &cluster.CircuitBreakers{Thresholds: thresholds}, nil
+}
+
+// newCircuitBreakerThresholds reads thresholds from the given annotation keys,
+// which are in the order of max connections, max pending requests, max
+// requests and max retries. Missing annotations fall back to the defaults.
+func newCircuitBreakerThresholds(svc *corev1.Service, keys [4]string, defaults *config.CircuitBreakerThresholds) (*cluster.CircuitBreakers_Thresholds, error) {
+	var (
+		t   cluster.CircuitBreakers_Thresholds
+		set bool
+	)
+
+	fields := []struct {
+		value  **types.UInt32Value
+		key    string
+		defVal uint32
+	}{
+		{&t.MaxConnections, keys[0], defaults.MaxConnections},
+		{&t.MaxPendingRequests, keys[1], defaults.MaxPendingRequests},
+		{&t.MaxRequests, keys[2], defaults.MaxRequests},
+		{&t.MaxRetries, keys[3], defaults.MaxRetries},
+	}
+
+	for _, f := range fields {
+		v, err := getUint32Annotation(svc, f.key)
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		if v == nil && f.defVal > 0 {
+			v = &types.UInt32Value{Value: f.defVal}
+		}
+
+		if v != nil {
+			*f.value = v
+			set = true
+		}
+	}
+
+	if !set {
+		return nil, nil
+	}
+
+	return &t, nil
+}
+
+func newOutlierDetection(svc *corev1.Service) (*cluster.OutlierDetection, error) {
+	var (
+		od  cluster.OutlierDetection
+		err error
+	)
+
+	if od.Consecutive_5Xx, err = getUint32Annotation(svc, AnnotationConsecutive5xx); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if od.ConsecutiveGatewayFailure, err = getUint32Annotation(svc, AnnotationConsecutiveGatewayFailure); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if od.Interval, err = getDurationAnnotation(svc, AnnotationOutlierInterval); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if od.BaseEjectionTime, err = getDurationAnnotation(svc, AnnotationBaseEjectionTime); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if od.MaxEjectionPercent, err = getPercentAnnotation(svc, AnnotationMaxEjectionPercent); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if od.Consecutive_5Xx == nil && od.ConsecutiveGatewayFailure == nil &&
+		od.Interval == nil && od.BaseEjectionTime == nil && od.MaxEjectionPercent == nil {
+		return nil, nil
+	}
+
+	// Envoy doesn't enforce ejections caused by gateway failures by default.
+	if od.ConsecutiveGatewayFailure != nil {
+		od.EnforcingConsecutiveGatewayFailure = &types.UInt32Value{Value: 100}
+	}
+
+	return &od, nil
+}
@@ -0,0 +1,200 @@
+package envoy
+
+import (
+	"time"
+
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/gogo/protobuf/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var _ = Describe("newCluster", func() {
+	var (
+		annotations map[string]string
+		conf        *config.EnvoyConfig
+		c           *api.Cluster
+		err         error
+	)
+
+	BeforeEach(func() {
+		annotations = map[string]string{}
+		conf = new(config.EnvoyConfig)
+	})
+
+	JustBeforeEach(func() {
+		c, err = newCluster("foo", newTestService(annotations), conf)
+	})
+
+	Describe("load balancer policy", func() {
+		It("should use round robin by default", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.LbPolicy).To(Equal(api.Cluster_ROUND_ROBIN))
+			Expect(c.LbConfig).To(BeNil())
+		})
+
+		Describe("given ring hash", func() {
+			BeforeEach(func() {
+				annotations[AnnotationLbPolicy] = "RING_HASH"
+				annotations[AnnotationMinimumRingSize] = "2048"
+			})
+
+			It("should set ring hash config", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(c.LbPolicy).To(Equal(api.Cluster_RING_HASH))
+				Expect(c.LbConfig).To(Equal(&api.Cluster_RingHashLbConfig_{
+					RingHashLbConfig: &api.Cluster_RingHashLbConfig{
+						MinimumRingSize: &types.UInt64Value{Value: 2048},
+					},
+				}))
+			})
+		})
+
+		It("should use ring hash when session affinity is ClientIP", func() {
+			svc := newTestService(map[string]string{})
+			svc.Spec.SessionAffinity = corev1.ServiceAffinityClientIP
+			c, err := newCluster("foo", svc, new(config.EnvoyConfig))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.LbPolicy).To(Equal(api.Cluster_RING_HASH))
+		})
+	})
+
+	Describe("DNS lookup family", func() {
+		It("should use IPv4 by default", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.DnsLookupFamily).To(Equal(api.Cluster_V4_ONLY))
+		})
+
+		Describe("given config", func() {
+			BeforeEach(func() {
+				conf.DNSLookupFamily = "AUTO"
+			})
+
+			It("should use the config", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(c.DnsLookupFamily).To(Equal(api.Cluster_AUTO))
+			})
+
+			It("should be overridden by annotations", func() {
+				c, err := newCluster("foo", newTestService(map[string]string{
+					AnnotationDNSLookupFamily: "V6_ONLY",
+				}), conf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(c.DnsLookupFamily).To(Equal(api.Cluster_V6_ONLY))
+			})
+		})
+	})
+
+	Describe("circuit breakers", func() {
+		It("should not set circuit breakers by default", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.CircuitBreakers).To(BeNil())
+		})
+
+		Describe("given annotations", func() {
+			BeforeEach(func() {
+				annotations[AnnotationMaxConnections] = "100"
+				annotations[AnnotationMaxRetries] = "3"
+				annotations[AnnotationHighPriorityMaxRequests] = "500"
+			})
+
+			It("should set thresholds", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(c.CircuitBreakers).To(Equal(&cluster.CircuitBreakers{
+					Thresholds: []*cluster.CircuitBreakers_Thresholds{
+						{
+							Priority:       core.RoutingPriority_DEFAULT,
+							MaxConnections: &types.UInt32Value{Value: 100},
+							MaxRetries:     &types.UInt32Value{Value: 3},
+						},
+						{
+							Priority:    core.RoutingPriority_HIGH,
+							MaxRequests: &types.UInt32Value{Value: 500},
+						},
+					},
+				}))
+			})
+		})
+
+		Describe("given defaults in config", func() {
+			BeforeEach(func() {
+				conf.CircuitBreakers.Default = config.CircuitBreakerThresholds{
+					MaxConnections:     1000,
+					MaxPendingRequests: 200,
+				}
+				annotations[AnnotationMaxConnections] = "10"
+			})
+
+			It("should prefer annotations over defaults", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(c.CircuitBreakers).To(Equal(&cluster.CircuitBreakers{
+					Thresholds: []*cluster.CircuitBreakers_Thresholds{
+						{
+							Priority:           core.RoutingPriority_DEFAULT,
+							MaxConnections:     &types.UInt32Value{Value: 10},
+							MaxPendingRequests: &types.UInt32Value{Value: 200},
+						},
+					},
+				}))
+			})
+		})
+	})
+
+	Describe("outlier detection", func() {
+		It("should not set outlier detection by default", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.OutlierDetection).To(BeNil())
+		})
+
+		Describe("given annotations", func() {
+			BeforeEach(func() {
+				annotations[AnnotationConsecutive5xx] = "5"
+				annotations[AnnotationOutlierInterval] = "10s"
+				annotations[AnnotationBaseEjectionTime] = "30s"
+				annotations[AnnotationMaxEjectionPercent] = "50"
+			})
+
+			It("should set outlier detection", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(c.OutlierDetection).To(Equal(&cluster.OutlierDetection{
+					Consecutive_5Xx:    &types.UInt32Value{Value: 5},
+					Interval:           durationPtr(10 * time.Second),
+					BaseEjectionTime:   durationPtr(30 * time.Second),
+					MaxEjectionPercent: &types.UInt32Value{Value: 50},
+				}))
+			})
+		})
+
+		Describe("given consecutive gateway failure", func() {
+			BeforeEach(func() {
+				annotations[AnnotationConsecutiveGatewayFailure] = "3"
+			})
+
+			It("should enforce gateway failure ejections", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(c.OutlierDetection).To(Equal(&cluster.OutlierDetection{
+					ConsecutiveGatewayFailure:          &types.UInt32Value{Value: 3},
+					EnforcingConsecutiveGatewayFailure: &types.UInt32Value{Value: 100},
+				}))
+			})
+		})
+	})
+
+	DescribeTable("invalid annotations", func(key, value string) {
+		_, err := newCluster("foo", newTestService(map[string]string{key: value}), new(config.EnvoyConfig))
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("connect timeout", AnnotationConnectTimeout, "foo"),
+		Entry("max connections", AnnotationMaxConnections, "foo"),
+		Entry("high priority max retries", AnnotationHighPriorityMaxRetries, "-1"),
+		Entry("outlier interval", AnnotationOutlierInterval, "foo"),
+		Entry("max ejection percent", AnnotationMaxEjectionPercent, "101"),
+		Entry("minimum ring size", AnnotationMinimumRingSize, "foo"),
+		Entry("DNS lookup family", AnnotationDNSLookupFamily, "V5_ONLY"),
+	)
+})
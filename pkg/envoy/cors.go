@@ -0,0 +1,56 @@
+package envoy
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ansel1/merry"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"github.com/gogo/protobuf/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func newCorsPolicy(svc *corev1.Service) (*route.CorsPolicy, error) {
+	policy := &route.CorsPolicy{
+		AllowOrigin:      getListAnnotation(svc, AnnotationCorsAllowOrigin),
+		AllowOriginRegex: getLinesAnnotation(svc, AnnotationCorsAllowOriginRegex),
+	}
+
+	if len(policy.AllowOrigin) == 0 && len(policy.AllowOriginRegex) == 0 {
+		return nil, nil
+	}
+
+	for _, s := range policy.AllowOriginRegex {
+		if _, err := regexp.Compile(s); err != nil {
+			return nil, newAnnotationError(svc, AnnotationCorsAllowOriginRegex).Append(err.Error())
+		}
+	}
+
+	policy.AllowMethods = strings.Join(getListAnnotation(svc, AnnotationCorsAllowMethods), ",")
+	policy.AllowHeaders = strings.Join(getListAnnotation(svc, AnnotationCorsAllowHeaders), ",")
+	policy.ExposeHeaders = strings.Join(getListAnnotation(svc, AnnotationCorsExposeHeaders), ",")
+
+	maxAge, err := getDurationAnnotation(svc, AnnotationCorsMaxAge)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	// Max age is sent in seconds.
+	if maxAge != nil {
+		policy.MaxAge = strconv.FormatInt(int64(maxAge.Seconds()), 10)
+	}
+
+	if s, ok := svc.Annotations[AnnotationCorsAllowCredentials]; ok {
+		v, err := strconv.ParseBool(s)
+
+		if err != nil {
+			return nil, newAnnotationError(svc, AnnotationCorsAllowCredentials).Append(err.Error())
+		}
+
+		policy.AllowCredentials = &types.BoolValue{Value: v}
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,62 @@
+package envoy
+
+import (
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"github.com/gogo/protobuf/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("newCorsPolicy", func() {
+	It("should return nil when origins are not set", func() {
+		policy, err := newCorsPolicy(newTestService(map[string]string{
+			AnnotationCorsAllowMethods: "GET",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(BeNil())
+	})
+
+	It("should set CORS policy", func() {
+		policy, err := newCorsPolicy(newTestService(map[string]string{
+			AnnotationCorsAllowOrigin:      "https://example.com",
+			AnnotationCorsAllowOriginRegex: `https://.*\.example\.com`,
+			AnnotationCorsAllowMethods:     "GET, POST",
+			AnnotationCorsAllowHeaders:     "authorization,content-type",
+			AnnotationCorsExposeHeaders:    "x-request-id",
+			AnnotationCorsMaxAge:           "24h",
+			AnnotationCorsAllowCredentials: "true",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(Equal(&route.CorsPolicy{
+			AllowOrigin:      []string{"https://example.com"},
+			AllowOriginRegex: []string{`https://.*\.example\.com`},
+			AllowMethods:     "GET,POST",
+			AllowHeaders:     "authorization,content-type",
+			ExposeHeaders:    "x-request-id",
+			MaxAge:           "86400",
+			AllowCredentials: &types.BoolValue{Value: true},
+		}))
+	})
+
+	It("should separate origin regexes by lines", func() {
+		policy, err := newCorsPolicy(newTestService(map[string]string{
+			AnnotationCorsAllowOriginRegex: "https://[a-z]{1,8}\\.example\\.com\nhttps://example\\.org",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy.AllowOriginRegex).To(Equal([]string{
+			`https://[a-z]{1,8}\.example\.com`,
+			`https://example\.org`,
+		}))
+	})
+
+	DescribeTable("invalid annotations", func(annotations map[string]string) {
+		annotations[AnnotationCorsAllowOrigin] = "*"
+		_, err := newCorsPolicy(newTestService(annotations))
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("origin regex", map[string]string{AnnotationCorsAllowOriginRegex: "(foo"}),
+		Entry("max age", map[string]string{AnnotationCorsMaxAge: "foo"}),
+		Entry("allow credentials", map[string]string{AnnotationCorsAllowCredentials: "foo"}),
+	)
+})
@@ -0,0 +1,251 @@
+package envoy
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DrainTracker remembers addresses of clusters, so addresses removed from
+// endpoints are published as draining, and addresses becoming not ready are
+// published as unhealthy for a grace period. Envoys can finish in-flight
+// requests instead of resetting them.
+type DrainTracker struct {
+	gracePeriod time.Duration
+
+	mutex      sync.Mutex
+	clusters   map[string]map[string]*drainEntry
+	generation uint64
+}
+
+type drainEntry struct {
+	Address   corev1.EndpointAddress
+	Port      uint32
+	RemovedAt time.Time
+}
+
+// Drains contains addresses of clusters returned by DrainTracker.Update,
+// including addresses in the grace period. It's shared by snapshots of all
+// node groups built in the same rebuild.
+type Drains struct {
+	clusters map[string][]endpointAddress
+}
+
+// get returns addresses of the cluster, and returns false if the cluster is
+// unknown or d is nil.
+func (d *Drains) get(cluster string) ([]endpointAddress, bool) {
+	if d == nil {
+		return nil, false
+	}
+
+	addresses, ok := d.clusters[cluster]
+	return addresses, ok
+}
+
+func NewDrainTracker(gracePeriod time.Duration) *DrainTracker {
+	return &DrainTracker{
+		gracePeriod: gracePeriod,
+		clusters:    map[string]map[string]*drainEntry{},
+	}
+}
+
+// Expire forgets addresses removed longer than the grace period ago.
+func (t *DrainTracker) Expire(now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	expired := false
+
+	for name, entries := range t.clusters {
+		for key, entry := range entries {
+			if !entry.RemovedAt.IsZero() && now.Sub(entry.RemovedAt) >= t.gracePeriod {
+				delete(entries, key)
+				expired = true
+			}
+		}
+
+		if len(entries) == 0 {
+			delete(t.clusters, name)
+		}
+	}
+
+	if expired {
+		t.generation++
+	}
+}
+
+// Generation is increased when addresses are forgotten. It should be included
+// in snapshot versions because snapshots change without changes of endpoints.
+func (t *DrainTracker) Generation() uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.generation
+}
+
+// Update records addresses of clusters built from endpoints, and forgets
+// clusters which are no longer built. It should be called once per rebuild
+// before snapshots are built, so addresses are removed at the same time for
+// all node groups.
+func (t *DrainTracker) Update(options *SnapshotOptions) (*Drains, error) {
+	conf := options.Config
+
+	if conf == nil {
+		conf = new(config.EnvoyConfig)
+	}
+
+	svcMap := getServiceMap(options.Services)
+	tcpProxies, err := getTCPProxies(svcMap)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	backends, err := getBackends(getExposedServices(svcMap), conf)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	epList, err := listEndpoints(options)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	now := options.getTime()
+	drains := &Drains{clusters: map[string][]endpointAddress{}}
+
+	for _, ep := range epList {
+		svc, ok := svcMap[ep.Name]
+
+		if !ok {
+			continue
+		}
+
+		// Ports of clusters of the service, keyed by cluster names.
+		ports := map[string]string{}
+
+		for _, port := range tcpProxies[ep.Name] {
+			ports[getTCPProxyClusterName(svc, port)] = port.ServicePort
+		}
+
+		if backends[ep.Name] {
+			ports[ep.Name] = svc.Annotations[AnnotationPort]
+		}
+
+		for name, port := range ports {
+			ready, notReady, err := getEndpointAddresses(svc, ep, port)
+
+			if err != nil {
+				return nil, merry.Wrap(err)
+			}
+
+			drains.clusters[name] = t.update(name, ready, notReady, now)
+		}
+	}
+
+	names := make(map[string]bool, len(drains.clusters))
+
+	for name := range drains.clusters {
+		names[name] = true
+	}
+
+	t.retain(names)
+
+	return drains, nil
+}
+
+// retain forgets clusters which are not in the given set, such as clusters of
+// deleted services. Otherwise their addresses would never expire, and would be
+// drained again if the clusters come back, even though the addresses may have
+// been reused by other pods.
+func (t *DrainTracker) retain(clusters map[string]bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for name := range t.clusters {
+		if !clusters[name] {
+			delete(t.clusters, name)
+		}
+	}
+}
+
+// update records ready addresses of a cluster, and returns them along with
+// addresses in the grace period. Not ready addresses are only returned if they
+// were ready before.
+func (t *DrainTracker) update(cluster string, ready, notReady []endpointAddress, now time.Time) []endpointAddress {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entries, ok := t.clusters[cluster]
+
+	if !ok {
+		entries = map[string]*drainEntry{}
+		t.clusters[cluster] = entries
+	}
+
+	result := ready
+	seen := map[string]bool{}
+
+	for _, addr := range ready {
+		key := getDrainKey(addr)
+		seen[key] = true
+		entries[key] = &drainEntry{Address: *addr.Address, Port: addr.Port}
+	}
+
+	for _, addr := range notReady {
+		key := getDrainKey(addr)
+		entry, ok := entries[key]
+
+		if !ok {
+			continue
+		}
+
+		seen[key] = true
+
+		if entry.RemovedAt.IsZero() {
+			entry.RemovedAt = now
+		}
+
+		addr.HealthStatus = core.HealthStatus_UNHEALTHY
+		result = append(result, addr)
+	}
+
+	keys := make([]string, 0, len(entries))
+
+	for key := range entries {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		entry := entries[key]
+
+		if entry.RemovedAt.IsZero() {
+			entry.RemovedAt = now
+		}
+
+		result = append(result, endpointAddress{
+			Address:      &entry.Address,
+			Port:         entry.Port,
+			HealthStatus: core.HealthStatus_DRAINING,
+		})
+	}
+
+	return result
+}
+
+func getDrainKey(addr endpointAddress) string {
+	return net.JoinHostPort(addr.Address.IP, strconv.FormatUint(uint64(addr.Port), 10))
+}
@@ -0,0 +1,185 @@
+package envoy
+
+import (
+	"time"
+
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var _ = Describe("DrainTracker", func() {
+	var (
+		tracker *DrainTracker
+		now     time.Time
+	)
+
+	newAddress := func(ip string) endpointAddress {
+		return endpointAddress{
+			Address: &corev1.EndpointAddress{IP: ip},
+			Port:    80,
+		}
+	}
+
+	getStatuses := func(addresses []endpointAddress) map[string]core.HealthStatus {
+		result := map[string]core.HealthStatus{}
+
+		for _, addr := range addresses {
+			result[addr.Address.IP] = addr.HealthStatus
+		}
+
+		return result
+	}
+
+	BeforeEach(func() {
+		tracker = NewDrainTracker(time.Minute)
+		now = time.Now()
+		tracker.update("foo", []endpointAddress{newAddress("10.1.1.0"), newAddress("10.1.1.1")}, nil, now)
+	})
+
+	It("should return ready addresses", func() {
+		Expect(getStatuses(tracker.update("foo", []endpointAddress{newAddress("10.1.1.0"), newAddress("10.1.1.1")}, nil, now))).To(Equal(map[string]core.HealthStatus{
+			"10.1.1.0": core.HealthStatus_UNKNOWN,
+			"10.1.1.1": core.HealthStatus_UNKNOWN,
+		}))
+	})
+
+	It("should drain removed addresses", func() {
+		Expect(getStatuses(tracker.update("foo", []endpointAddress{newAddress("10.1.1.0")}, nil, now))).To(Equal(map[string]core.HealthStatus{
+			"10.1.1.0": core.HealthStatus_UNKNOWN,
+			"10.1.1.1": core.HealthStatus_DRAINING,
+		}))
+	})
+
+	It("should mark addresses becoming not ready as unhealthy", func() {
+		Expect(getStatuses(tracker.update("foo", []endpointAddress{newAddress("10.1.1.0")}, []endpointAddress{newAddress("10.1.1.1")}, now))).To(Equal(map[string]core.HealthStatus{
+			"10.1.1.0": core.HealthStatus_UNKNOWN,
+			"10.1.1.1": core.HealthStatus_UNHEALTHY,
+		}))
+	})
+
+	It("should ignore addresses which were never ready", func() {
+		Expect(getStatuses(tracker.update("foo", []endpointAddress{newAddress("10.1.1.0"), newAddress("10.1.1.1")}, []endpointAddress{newAddress("10.1.1.2")}, now))).NotTo(HaveKey("10.1.1.2"))
+	})
+
+	It("should forget addresses after the grace period", func() {
+		tracker.update("foo", []endpointAddress{newAddress("10.1.1.0")}, nil, now)
+
+		tracker.Expire(now.Add(30 * time.Second))
+		Expect(tracker.Generation()).To(BeZero())
+
+		tracker.Expire(now.Add(time.Minute))
+		Expect(tracker.Generation()).To(Equal(uint64(1)))
+		Expect(getStatuses(tracker.update("foo", []endpointAddress{newAddress("10.1.1.0")}, nil, now))).To(Equal(map[string]core.HealthStatus{
+			"10.1.1.0": core.HealthStatus_UNKNOWN,
+		}))
+	})
+
+	It("should forget clusters which are not retained", func() {
+		tracker.update("bar", []endpointAddress{newAddress("10.1.2.0")}, nil, now)
+		tracker.retain(map[string]bool{"bar": true})
+		Expect(getStatuses(tracker.update("foo", nil, nil, now))).To(BeEmpty())
+		Expect(getStatuses(tracker.update("bar", nil, nil, now))).To(Equal(map[string]core.HealthStatus{
+			"10.1.2.0": core.HealthStatus_DRAINING,
+		}))
+	})
+
+	It("should keep addresses ready again", func() {
+		tracker.update("foo", []endpointAddress{newAddress("10.1.1.0")}, nil, now)
+		tracker.update("foo", []endpointAddress{newAddress("10.1.1.0"), newAddress("10.1.1.1")}, nil, now)
+		tracker.Expire(now.Add(time.Hour))
+		Expect(tracker.Generation()).To(BeZero())
+	})
+})
+
+var _ = Describe("DrainTracker.Update", func() {
+	var (
+		tracker             *DrainTracker
+		endpoints, services cache.Store
+		now                 time.Time
+	)
+
+	setSubsets := func(subsets []corev1.EndpointSubset) {
+		Expect(endpoints.Add(&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+			Subsets:    subsets,
+		})).To(Succeed())
+	}
+
+	update := func() *Drains {
+		drains, err := tracker.Update(&SnapshotOptions{
+			Endpoints: endpoints,
+			Services:  services,
+			Time:      now,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return drains
+	}
+
+	newSnapshot := func(drains *Drains, locality *core.Locality) *api.ClusterLoadAssignment {
+		snapshot, err := NewSnapshot(&SnapshotOptions{
+			Endpoints: endpoints,
+			Services:  services,
+			Drains:    drains,
+			Locality:  locality,
+			Time:      now,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return snapshot.Endpoints.Items["foo"].(*api.ClusterLoadAssignment)
+	}
+
+	BeforeEach(func() {
+		tracker = NewDrainTracker(time.Minute)
+		endpoints = cache.NewStore(cache.MetaNamespaceKeyFunc)
+		services = cache.NewStore(cache.MetaNamespaceKeyFunc)
+		now = time.Now()
+
+		Expect(services.Add(&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "foo",
+				Namespace:   "default",
+				Annotations: map[string]string{AnnotationDomains: "*"},
+			},
+		})).To(Succeed())
+		setSubsets([]corev1.EndpointSubset{
+			{
+				Addresses: []corev1.EndpointAddress{{IP: "10.1.1.0"}},
+				Ports:     []corev1.EndpointPort{{Port: 80}},
+			},
+		})
+		update()
+	})
+
+	It("should drain addresses in snapshots of all node groups", func() {
+		setSubsets(nil)
+		drains := update()
+
+		for _, locality := range []*core.Locality{nil, {Zone: "us-east1-b"}} {
+			cla := newSnapshot(drains, locality)
+			Expect(cla.Endpoints).To(HaveLen(1))
+			Expect(cla.Endpoints[0].LbEndpoints).To(HaveLen(1))
+			Expect(cla.Endpoints[0].LbEndpoints[0].HealthStatus).To(Equal(core.HealthStatus_DRAINING))
+		}
+	})
+
+	It("should forget clusters which are no longer built", func() {
+		Expect(services.Delete(&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		})).To(Succeed())
+		update()
+
+		Expect(services.Add(&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "foo",
+				Namespace:   "default",
+				Annotations: map[string]string{AnnotationDomains: "*"},
+			},
+		})).To(Succeed())
+		setSubsets(nil)
+		Expect(newSnapshot(update(), nil).Endpoints).To(BeEmpty())
+	})
+})
@@ -0,0 +1,176 @@
+package envoy
+
+import (
+	"sort"
+
+	"github.com/ansel1/merry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+// LabelServiceName is the label of EndpointSlices referring to their services.
+const LabelServiceName = "kubernetes.io/service-name"
+
+// endpointSlice contains fields of discovery.k8s.io/v1 EndpointSlices used by
+// snapshots.
+type endpointSlice struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	AddressType string                  `json:"addressType"`
+	Endpoints   []endpointSliceEndpoint `json:"endpoints"`
+	Ports       []endpointSlicePort     `json:"ports"`
+}
+
+type endpointSliceEndpoint struct {
+	Addresses  []string                `json:"addresses"`
+	Conditions endpointSliceConditions `json:"conditions"`
+	Hostname   *string                 `json:"hostname,omitempty"`
+	NodeName   *string                 `json:"nodeName,omitempty"`
+	TargetRef  *corev1.ObjectReference `json:"targetRef,omitempty"`
+}
+
+type endpointSliceConditions struct {
+	Ready *bool `json:"ready,omitempty"`
+}
+
+type endpointSlicePort struct {
+	Name     *string          `json:"name,omitempty"`
+	Port     *int32           `json:"port,omitempty"`
+	Protocol *corev1.Protocol `json:"protocol,omitempty"`
+}
+
+// listEndpoints returns endpoints of services, which are aggregated from
+// EndpointSlices when they are given.
+func listEndpoints(options *SnapshotOptions) ([]*corev1.Endpoints, error) {
+	if options.EndpointSlices != nil {
+		return getSliceEndpoints(options.EndpointSlices)
+	}
+
+	var result []*corev1.Endpoints
+
+	for _, obj := range options.Endpoints.List() {
+		if ep, ok := obj.(*corev1.Endpoints); ok {
+			result = append(result, ep)
+		}
+	}
+
+	return result, nil
+}
+
+// getSliceEndpoints aggregates EndpointSlices of each service into an
+// Endpoints. Each slice becomes a subset because ports of slices of a service
+// can be different.
+func getSliceEndpoints(slices cache.Store) ([]*corev1.Endpoints, error) {
+	epMap := map[string]*corev1.Endpoints{}
+	objs := slices.List()
+
+	// Slices are sorted so subsets are in the same order on every rebuild.
+	sort.Slice(objs, func(i, j int) bool {
+		a, _ := cache.MetaNamespaceKeyFunc(objs[i])
+		b, _ := cache.MetaNamespaceKeyFunc(objs[j])
+		return a < b
+	})
+
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+
+		if !ok {
+			continue
+		}
+
+		var slice endpointSlice
+
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &slice); err != nil {
+			return nil, merry.Wrap(err).WithValue("endpointSlice", u.GetName())
+		}
+
+		name := slice.Labels[LabelServiceName]
+
+		// FQDN slices are managed by other controllers and can't be used as
+		// addresses of static endpoints.
+		if name == "" || (slice.AddressType != "IPv4" && slice.AddressType != "IPv6") {
+			continue
+		}
+
+		key := slice.Namespace + "/" + name
+		ep, ok := epMap[key]
+
+		if !ok {
+			ep = &corev1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: slice.Namespace,
+				},
+			}
+			epMap[key] = ep
+		}
+
+		if subset := newSliceEndpointSubset(&slice); len(subset.Addresses)+len(subset.NotReadyAddresses) > 0 {
+			ep.Subsets = append(ep.Subsets, subset)
+		}
+	}
+
+	keys := make([]string, 0, len(epMap))
+
+	for key := range epMap {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	result := make([]*corev1.Endpoints, 0, len(keys))
+
+	for _, key := range keys {
+		result = append(result, epMap[key])
+	}
+
+	return result, nil
+}
+
+func newSliceEndpointSubset(slice *endpointSlice) corev1.EndpointSubset {
+	var subset corev1.EndpointSubset
+
+	for _, port := range slice.Ports {
+		// Ports without numbers refer to all ports, which are not supported.
+		if port.Port == nil {
+			continue
+		}
+
+		p := corev1.EndpointPort{Port: *port.Port}
+
+		if port.Name != nil {
+			p.Name = *port.Name
+		}
+
+		if port.Protocol != nil {
+			p.Protocol = *port.Protocol
+		}
+
+		subset.Ports = append(subset.Ports, p)
+	}
+
+	for _, e := range slice.Endpoints {
+		for _, ip := range e.Addresses {
+			addr := corev1.EndpointAddress{
+				IP:        ip,
+				NodeName:  e.NodeName,
+				TargetRef: e.TargetRef,
+			}
+
+			if e.Hostname != nil {
+				addr.Hostname = *e.Hostname
+			}
+
+			// Endpoints without the ready condition should be considered ready.
+			if e.Conditions.Ready == nil || *e.Conditions.Ready {
+				subset.Addresses = append(subset.Addresses, addr)
+			} else {
+				subset.NotReadyAddresses = append(subset.NotReadyAddresses, addr)
+			}
+		}
+	}
+
+	return subset
+}
@@ -0,0 +1,174 @@
+package envoy
+
+import (
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoycache "github.com/envoyproxy/go-control-plane/pkg/cache"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestEndpointSlice(name, service, addressType string, endpoints []interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "discovery.k8s.io/v1",
+			"kind":       "EndpointSlice",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": "default",
+				"labels": map[string]interface{}{
+					LabelServiceName: service,
+				},
+			},
+			"addressType": addressType,
+			"endpoints":   endpoints,
+			"ports": []interface{}{
+				map[string]interface{}{"name": "http", "port": int64(80), "protocol": "TCP"},
+			},
+		},
+	}
+}
+
+var _ = Describe("getSliceEndpoints", func() {
+	var slices cache.Store
+
+	BeforeEach(func() {
+		slices = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	})
+
+	It("should aggregate slices of a service", func() {
+		Expect(slices.Add(newTestEndpointSlice("foo-b", "foo", "IPv4", []interface{}{
+			map[string]interface{}{
+				"addresses":  []interface{}{"10.0.0.2"},
+				"conditions": map[string]interface{}{"ready": false},
+			},
+		}))).To(Succeed())
+		Expect(slices.Add(newTestEndpointSlice("foo-a", "foo", "IPv4", []interface{}{
+			map[string]interface{}{
+				"addresses":  []interface{}{"10.0.0.1"},
+				"conditions": map[string]interface{}{"ready": true},
+				"nodeName":   "node-a",
+				"targetRef":  map[string]interface{}{"kind": "Pod", "namespace": "default", "name": "foo-1"},
+			},
+		}))).To(Succeed())
+
+		nodeName := "node-a"
+		ports := []corev1.EndpointPort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}}
+		Expect(getSliceEndpoints(slices)).To(Equal([]*corev1.Endpoints{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+				Subsets: []corev1.EndpointSubset{
+					{
+						Addresses: []corev1.EndpointAddress{
+							{
+								IP:        "10.0.0.1",
+								NodeName:  &nodeName,
+								TargetRef: &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "foo-1"},
+							},
+						},
+						Ports: ports,
+					},
+					{
+						NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.0.0.2"}},
+						Ports:             ports,
+					},
+				},
+			},
+		}))
+	})
+
+	It("should treat endpoints without conditions as ready", func() {
+		Expect(slices.Add(newTestEndpointSlice("foo-a", "foo", "IPv4", []interface{}{
+			map[string]interface{}{"addresses": []interface{}{"10.0.0.1"}},
+		}))).To(Succeed())
+
+		result, err := getSliceEndpoints(slices)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(HaveLen(1))
+		Expect(result[0].Subsets[0].Addresses).To(Equal([]corev1.EndpointAddress{{IP: "10.0.0.1"}}))
+	})
+
+	It("should keep services whose slices are empty", func() {
+		Expect(slices.Add(newTestEndpointSlice("foo-a", "foo", "IPv4", []interface{}{}))).To(Succeed())
+		Expect(getSliceEndpoints(slices)).To(Equal([]*corev1.Endpoints{
+			{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}},
+		}))
+	})
+
+	It("should skip FQDN slices and slices without services", func() {
+		Expect(slices.Add(newTestEndpointSlice("foo-a", "foo", "FQDN", []interface{}{
+			map[string]interface{}{"addresses": []interface{}{"example.com"}},
+		}))).To(Succeed())
+		Expect(slices.Add(newTestEndpointSlice("bar-a", "", "IPv4", []interface{}{
+			map[string]interface{}{"addresses": []interface{}{"10.0.0.1"}},
+		}))).To(Succeed())
+
+		Expect(getSliceEndpoints(slices)).To(BeEmpty())
+	})
+})
+
+var _ = Describe("NewSnapshot with EndpointSlices", func() {
+	var (
+		slices, services cache.Store
+		snapshot         *envoycache.Snapshot
+	)
+
+	addService := func(name string) {
+		Expect(services.Add(&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kds.kubenvoy.dev/domains": name + ".example.com",
+				},
+			},
+		})).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		slices = cache.NewStore(cache.MetaNamespaceKeyFunc)
+		services = cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+		addService("foo")
+		addService("bar")
+		Expect(slices.Add(newTestEndpointSlice("foo-a", "foo", "IPv4", []interface{}{}))).To(Succeed())
+		Expect(slices.Add(newTestEndpointSlice("bar-a", "bar", "IPv4", []interface{}{
+			map[string]interface{}{"addresses": []interface{}{"10.0.0.1"}},
+		}))).To(Succeed())
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		snapshot, err = NewSnapshot(&SnapshotOptions{
+			EndpointSlices: slices,
+			Services:       services,
+		})
+
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should skip services whose slices are empty", func() {
+		Expect(snapshot.Clusters.Items).NotTo(HaveKey("foo"))
+		Expect(snapshot.Endpoints.Items).NotTo(HaveKey("foo"))
+	})
+
+	It("should build other services", func() {
+		Expect(snapshot.Clusters.Items).To(HaveKey("bar"))
+
+		routeConf := snapshot.Routes.Items["kds"].(*api.RouteConfiguration)
+		Expect(routeConf.VirtualHosts).To(HaveLen(1))
+		Expect(routeConf.VirtualHosts[0].Domains).To(Equal([]string{"bar.example.com"}))
+	})
+})
+
+var _ = Describe("listEndpoints", func() {
+	It("should list endpoints when slices are not given", func() {
+		endpoints := cache.NewStore(cache.MetaNamespaceKeyFunc)
+		ep := &corev1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+		Expect(endpoints.Add(ep)).To(Succeed())
+		Expect(listEndpoints(&SnapshotOptions{Endpoints: endpoints})).To(Equal([]*corev1.Endpoints{ep}))
+	})
+})
@@ -0,0 +1,129 @@
+package envoy
+
+import (
+	"strconv"
+
+	"github.com/ansel1/merry"
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultExternalPort    = 80
+	defaultExternalTLSPort = 443
+)
+
+func isExternalService(svc *corev1.Service) bool {
+	return svc.Spec.Type == corev1.ServiceTypeExternalName && svc.Spec.ExternalName != ""
+}
+
+// newExternalCluster returns a DNS cluster for an ExternalName service. The
+// cluster resolves spec.externalName instead of discovering endpoints with EDS.
+func newExternalCluster(svc *corev1.Service, conf *config.EnvoyConfig) (*api.Cluster, error) {
+	c, err := newCluster(svc.Name, svc, conf)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if c.Type, err = getDNSType(svc); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	useTLS, err := isUpstreamTLS(svc)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	port := uint32(defaultExternalPort)
+
+	if useTLS {
+		port = defaultExternalTLSPort
+		c.TlsContext = newUpstreamTLSContext(svc)
+	}
+
+	if p := getExternalPort(svc); p != nil {
+		port = uint32(p.Port)
+	}
+
+	c.EdsClusterConfig = nil
+	c.LoadAssignment = &api.ClusterLoadAssignment{
+		ClusterName: c.Name,
+		Endpoints: []endpoint.LocalityLbEndpoints{
+			{
+				LbEndpoints: []endpoint.LbEndpoint{
+					{
+						HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+							Endpoint: &endpoint.Endpoint{
+								Address: newSocketAddress(svc.Spec.ExternalName, port),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	return c, nil
+}
+
+// getDNSType returns the discovery type set in annotations. Only STRICT_DNS
+// and LOGICAL_DNS are allowed, and STRICT_DNS is used by default.
+func getDNSType(svc *corev1.Service) (api.Cluster_DiscoveryType, error) {
+	switch s := svc.Annotations[AnnotationDNSType]; s {
+	case "", api.Cluster_STRICT_DNS.String():
+		return api.Cluster_STRICT_DNS, nil
+	case api.Cluster_LOGICAL_DNS.String():
+		return api.Cluster_LOGICAL_DNS, nil
+	default:
+		return 0, newAnnotationError(svc, AnnotationDNSType)
+	}
+}
+
+func isUpstreamTLS(svc *corev1.Service) (bool, error) {
+	s, ok := svc.Annotations[AnnotationUpstreamTLS]
+
+	if !ok {
+		return false, nil
+	}
+
+	v, err := strconv.ParseBool(s)
+
+	if err != nil {
+		return false, newAnnotationError(svc, AnnotationUpstreamTLS).Append(err.Error())
+	}
+
+	return v, nil
+}
+
+// newUpstreamTLSContext returns the TLS context of the cluster. SNI defaults to
+// the external name.
+func newUpstreamTLSContext(svc *corev1.Service) *auth.UpstreamTlsContext {
+	sni := svc.Annotations[AnnotationUpstreamSNI]
+
+	if sni == "" {
+		sni = svc.Spec.ExternalName
+	}
+
+	return &auth.UpstreamTlsContext{Sni: sni}
+}
+
+// getExternalPort returns the service port set in the port annotation, or the
+// first port of the service.
+func getExternalPort(svc *corev1.Service) *corev1.ServicePort {
+	if name := svc.Annotations[AnnotationPort]; name != "" {
+		if p := getServicePort(svc, name); p != nil {
+			return p
+		}
+	}
+
+	if len(svc.Spec.Ports) > 0 {
+		return &svc.Spec.Ports[0]
+	}
+
+	return nil
+}
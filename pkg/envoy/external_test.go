@@ -0,0 +1,96 @@
+package envoy
+
+import (
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var _ = Describe("newExternalCluster", func() {
+	var (
+		svc *corev1.Service
+		c   *api.Cluster
+		err error
+	)
+
+	BeforeEach(func() {
+		svc = newTestService(map[string]string{})
+		svc.Spec.Type = corev1.ServiceTypeExternalName
+		svc.Spec.ExternalName = "api.example.com"
+	})
+
+	JustBeforeEach(func() {
+		c, err = newExternalCluster(svc, new(config.EnvoyConfig))
+	})
+
+	It("should resolve the external name with strict DNS", func() {
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Type).To(Equal(api.Cluster_STRICT_DNS))
+		Expect(c.EdsClusterConfig).To(BeNil())
+		Expect(c.TlsContext).To(BeNil())
+		Expect(c.LoadAssignment.ClusterName).To(Equal("foo"))
+		Expect(c.LoadAssignment.Endpoints[0].LbEndpoints[0].GetEndpoint().Address).To(Equal(newSocketAddress("api.example.com", 80)))
+	})
+
+	Describe("given logical DNS", func() {
+		BeforeEach(func() {
+			svc.Annotations[AnnotationDNSType] = "LOGICAL_DNS"
+		})
+
+		It("should use logical DNS", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.Type).To(Equal(api.Cluster_LOGICAL_DNS))
+		})
+	})
+
+	Describe("given invalid DNS type", func() {
+		BeforeEach(func() {
+			svc.Annotations[AnnotationDNSType] = "EDS"
+		})
+
+		It("should return an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("given upstream TLS", func() {
+		BeforeEach(func() {
+			svc.Annotations[AnnotationUpstreamTLS] = "true"
+		})
+
+		It("should use port 443 and the external name as SNI", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.TlsContext).To(Equal(&auth.UpstreamTlsContext{Sni: "api.example.com"}))
+			Expect(c.LoadAssignment.Endpoints[0].LbEndpoints[0].GetEndpoint().Address).To(Equal(newSocketAddress("api.example.com", 443)))
+		})
+
+		Describe("and SNI", func() {
+			BeforeEach(func() {
+				svc.Annotations[AnnotationUpstreamSNI] = "example.com"
+			})
+
+			It("should set SNI", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(c.TlsContext).To(Equal(&auth.UpstreamTlsContext{Sni: "example.com"}))
+			})
+		})
+	})
+
+	Describe("given service ports", func() {
+		BeforeEach(func() {
+			svc.Annotations[AnnotationPort] = "https"
+			svc.Spec.Ports = []corev1.ServicePort{
+				{Name: "http", Port: 8080},
+				{Name: "https", Port: 8443},
+			}
+		})
+
+		It("should use the port in annotations", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.LoadAssignment.Endpoints[0].LbEndpoints[0].GetEndpoint().Address).To(Equal(newSocketAddress("api.example.com", 8443)))
+		})
+	})
+})
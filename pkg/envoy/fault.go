@@ -0,0 +1,112 @@
+package envoy
+
+import (
+	"github.com/ansel1/merry"
+	faultcommon "github.com/envoyproxy/go-control-plane/envoy/config/filter/fault/v2"
+	fault "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/fault/v2"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/gogo/protobuf/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// newFaultConfig returns the per-route config of the fault filter. Faults are
+// applied to all requests unless percentages are given.
+func newFaultConfig(svc *corev1.Service) (*types.Struct, error) {
+	var (
+		conf fault.HTTPFault
+		err  error
+	)
+
+	if conf.Delay, err = newFaultDelay(svc); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if conf.Abort, err = newFaultAbort(svc); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if conf.Delay == nil && conf.Abort == nil {
+		return nil, nil
+	}
+
+	result, err := util.MessageToStruct(&conf)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	return result, nil
+}
+
+func newFaultDelay(svc *corev1.Service) (*faultcommon.FaultDelay, error) {
+	delay, err := getDurationAnnotation(svc, AnnotationFaultDelay)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if delay == nil {
+		return nil, nil
+	}
+
+	percentage, err := getFaultPercentage(svc, AnnotationFaultDelayPercent)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	return &faultcommon.FaultDelay{
+		Type: faultcommon.FaultDelay_FIXED,
+		FaultDelaySecifier: &faultcommon.FaultDelay_FixedDelay{
+			FixedDelay: delay,
+		},
+		Percentage: percentage,
+	}, nil
+}
+
+func newFaultAbort(svc *corev1.Service) (*fault.FaultAbort, error) {
+	s, ok := svc.Annotations[AnnotationFaultAbortStatus]
+
+	if !ok {
+		return nil, nil
+	}
+
+	status, err := parseStatusCode(s)
+
+	if err != nil {
+		return nil, merry.WithValue(err, "service", svc.Name)
+	}
+
+	percentage, err := getFaultPercentage(svc, AnnotationFaultAbortPercent)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	return &fault.FaultAbort{
+		ErrorType: &fault.FaultAbort_HttpStatus{
+			HttpStatus: uint32(status),
+		},
+		Percentage: percentage,
+	}, nil
+}
+
+func getFaultPercentage(svc *corev1.Service, key string) (*envoy_type.FractionalPercent, error) {
+	percent, err := getPercentAnnotation(svc, key)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	result := &envoy_type.FractionalPercent{
+		Numerator:   100,
+		Denominator: envoy_type.FractionalPercent_HUNDRED,
+	}
+
+	if percent != nil {
+		result.Numerator = percent.Value
+	}
+
+	return result, nil
+}
@@ -0,0 +1,64 @@
+package envoy
+
+import (
+	"time"
+
+	faultcommon "github.com/envoyproxy/go-control-plane/envoy/config/filter/fault/v2"
+	fault "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/fault/v2"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("newFaultConfig", func() {
+	It("should return nil by default", func() {
+		conf, err := newFaultConfig(newTestService(map[string]string{}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf).To(BeNil())
+	})
+
+	It("should set delay and abort", func() {
+		conf, err := newFaultConfig(newTestService(map[string]string{
+			AnnotationFaultDelay:        "2s",
+			AnnotationFaultAbortStatus:  "503",
+			AnnotationFaultAbortPercent: "10",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+
+		expected, err := util.MessageToStruct(&fault.HTTPFault{
+			Delay: &faultcommon.FaultDelay{
+				Type: faultcommon.FaultDelay_FIXED,
+				FaultDelaySecifier: &faultcommon.FaultDelay_FixedDelay{
+					FixedDelay: durationPtr(2 * time.Second),
+				},
+				Percentage: &envoy_type.FractionalPercent{
+					Numerator:   100,
+					Denominator: envoy_type.FractionalPercent_HUNDRED,
+				},
+			},
+			Abort: &fault.FaultAbort{
+				ErrorType: &fault.FaultAbort_HttpStatus{
+					HttpStatus: 503,
+				},
+				Percentage: &envoy_type.FractionalPercent{
+					Numerator:   10,
+					Denominator: envoy_type.FractionalPercent_HUNDRED,
+				},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf).To(Equal(expected))
+	})
+
+	DescribeTable("invalid annotations", func(annotations map[string]string) {
+		_, err := newFaultConfig(newTestService(annotations))
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("delay", map[string]string{AnnotationFaultDelay: "foo"}),
+		Entry("delay percent", map[string]string{AnnotationFaultDelay: "1s", AnnotationFaultDelayPercent: "200"}),
+		Entry("abort status", map[string]string{AnnotationFaultAbortStatus: "foo"}),
+		Entry("abort percent", map[string]string{AnnotationFaultAbortStatus: "503", AnnotationFaultAbortPercent: "-1"}),
+	)
+})
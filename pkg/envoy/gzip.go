@@ -0,0 +1,156 @@
+package envoy
+
+import (
+	"strconv"
+
+	"github.com/ansel1/merry"
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	gzip "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/gzip/v2"
+	lua "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/lua/v2"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/gogo/protobuf/types"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func isGzipEnabled(svc *corev1.Service, conf *config.GzipConfig) (bool, error) {
+	s, ok := svc.Annotations[AnnotationGzip]
+
+	if !ok {
+		return conf.Enabled, nil
+	}
+
+	v, err := strconv.ParseBool(s)
+
+	if err != nil {
+		return false, newAnnotationError(svc, AnnotationGzip).Append(err.Error())
+	}
+
+	return v, nil
+}
+
+// isGzipDisabled returns true if the service opts out of gzip explicitly.
+func isGzipDisabled(svc *corev1.Service) bool {
+	v, err := strconv.ParseBool(svc.Annotations[AnnotationGzip])
+	return err == nil && !v
+}
+
+func newGzipFilter(conf *config.GzipConfig) (*hcm.HttpFilter, error) {
+	gzipConf := &gzip.Gzip{
+		ContentType: conf.ContentTypes,
+	}
+
+	if conf.MinContentLength > 0 {
+		gzipConf.ContentLength = &types.UInt32Value{Value: conf.MinContentLength}
+	}
+
+	switch conf.CompressionLevel {
+	case "", "default":
+		gzipConf.CompressionLevel = gzip.Gzip_CompressionLevel_DEFAULT
+	case "best":
+		gzipConf.CompressionLevel = gzip.Gzip_CompressionLevel_BEST
+	case "speed":
+		gzipConf.CompressionLevel = gzip.Gzip_CompressionLevel_SPEED
+	default:
+		return nil, ErrInvalidCompressionLevel.Here().WithValue("level", conf.CompressionLevel)
+	}
+
+	s, err := util.MessageToStruct(gzipConf)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	return &hcm.HttpFilter{
+		Name: util.Gzip,
+		ConfigType: &hcm.HttpFilter_Config{
+			Config: s,
+		},
+	}, nil
+}
+
+// gzipDisabledHeader marks responses of routes opting out of gzip. It's
+// removed by the gzip cleanup filter with the no-transform directive added
+// along with it.
+const gzipDisabledHeader = "x-kds-gzip-disabled"
+
+// gzipCleanupCode removes the marker header and the last cache-control value,
+// which is the no-transform directive added by the route. Other values, such
+// as cache-control of upstreams, are added back in the same order.
+const gzipCleanupCode = `function envoy_on_response(handle)
+  local headers = handle:headers()
+
+  if headers:get("` + gzipDisabledHeader + `") == nil then
+    return
+  end
+
+  local values = {}
+
+  for key, value in pairs(headers) do
+    if key == "cache-control" then
+      table.insert(values, value)
+    end
+  end
+
+  table.remove(values)
+  headers:remove("` + gzipDisabledHeader + `")
+  headers:remove("cache-control")
+
+  for _, value in ipairs(values) do
+    headers:add("cache-control", value)
+  end
+end
+`
+
+// disableGzip prevents responses of routes to upstreams from being compressed.
+// The gzip filter doesn't support per-route config, but it skips responses
+// with "Cache-Control: no-transform". The header is removed by the gzip
+// cleanup filter after the gzip filter, so clients and caches don't see it.
+func disableGzip(routes []route.Route) {
+	for i := range routes {
+		if routes[i].GetRoute() == nil {
+			continue
+		}
+
+		routes[i].ResponseHeadersToAdd = append(routes[i].ResponseHeadersToAdd,
+			newHeaderValueOption("cache-control", "no-transform"),
+			newHeaderValueOption(gzipDisabledHeader, "true"))
+	}
+}
+
+// hasGzipDisabledRoutes returns true if any route opts out of gzip.
+func hasGzipDisabledRoutes(routeConf *api.RouteConfiguration) bool {
+	for _, vh := range routeConf.VirtualHosts {
+		for _, r := range vh.Routes {
+			for _, h := range r.ResponseHeadersToAdd {
+				if h.Header != nil && h.Header.Key == gzipDisabledHeader {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// newGzipCleanupFilter returns a Lua filter removing headers added by
+// disableGzip. Filters encode responses in the reverse order, so it must be
+// placed before the gzip filter.
+func newGzipCleanupFilter() (*hcm.HttpFilter, error) {
+	s, err := util.MessageToStruct(&lua.Lua{
+		InlineCode: gzipCleanupCode,
+	})
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	return &hcm.HttpFilter{
+		Name: util.Lua,
+		ConfigType: &hcm.HttpFilter_Config{
+			Config: s,
+		},
+	}, nil
+}
@@ -0,0 +1,60 @@
+package envoy
+
+import (
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/tommy351/kubenvoy/pkg/config"
+)
+
+var _ = Describe("isGzipEnabled", func() {
+	DescribeTable("success", func(expected bool, annotations map[string]string, conf *config.GzipConfig) {
+		Expect(isGzipEnabled(newTestService(annotations), conf)).To(Equal(expected))
+	},
+		Entry("default", false, map[string]string{}, &config.GzipConfig{}),
+		Entry("enabled in config", true, map[string]string{}, &config.GzipConfig{Enabled: true}),
+		Entry("enabled by annotation", true, map[string]string{AnnotationGzip: "true"}, &config.GzipConfig{}),
+		Entry("disabled by annotation", false, map[string]string{AnnotationGzip: "false"}, &config.GzipConfig{Enabled: true}),
+	)
+
+	It("should return an error when annotation is invalid", func() {
+		_, err := isGzipEnabled(newTestService(map[string]string{AnnotationGzip: "foo"}), &config.GzipConfig{})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("isGzipDisabled", func() {
+	DescribeTable("success", func(expected bool, annotations map[string]string) {
+		Expect(isGzipDisabled(newTestService(annotations))).To(Equal(expected))
+	},
+		Entry("default", false, map[string]string{}),
+		Entry("enabled by annotation", false, map[string]string{AnnotationGzip: "true"}),
+		Entry("disabled by annotation", true, map[string]string{AnnotationGzip: "false"}),
+	)
+})
+
+var _ = Describe("newGzipFilter", func() {
+	It("should return an error when compression level is invalid", func() {
+		_, err := newGzipFilter(&config.GzipConfig{CompressionLevel: "foo"})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("disableGzip", func() {
+	It("should add no-transform to responses", func() {
+		routes := []route.Route{{Action: &route.Route_Route{Route: &route.RouteAction{}}}}
+		disableGzip(routes)
+		Expect(routes[0].ResponseHeadersToAdd).To(Equal([]*core.HeaderValueOption{
+			newHeaderValueOption("cache-control", "no-transform"),
+			newHeaderValueOption(gzipDisabledHeader, "true"),
+		}))
+	})
+
+	It("should skip redirect routes", func() {
+		routes := []route.Route{{Action: &route.Route_Redirect{Redirect: &route.RedirectAction{}}}}
+		disableGzip(routes)
+		Expect(routes[0].ResponseHeadersToAdd).To(BeEmpty())
+	})
+})
@@ -0,0 +1,85 @@
+package envoy
+
+import (
+	"strings"
+
+	"github.com/ansel1/merry"
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func setRouteHeaders(svc *corev1.Service, r *route.Route) (err error) {
+	if r.RequestHeadersToAdd, err = getHeadersAnnotation(svc, AnnotationRequestHeadersToAdd); err != nil {
+		return merry.Wrap(err)
+	}
+
+	if r.ResponseHeadersToAdd, err = getHeadersAnnotation(svc, AnnotationResponseHeadersToAdd); err != nil {
+		return merry.Wrap(err)
+	}
+
+	r.RequestHeadersToRemove = getListAnnotation(svc, AnnotationRequestHeadersToRemove)
+	r.ResponseHeadersToRemove = getListAnnotation(svc, AnnotationResponseHeadersToRemove)
+
+	return nil
+}
+
+func setRouteConfigurationHeaders(conf *config.HeadersConfig, routeConf *api.RouteConfiguration) (err error) {
+	if routeConf.RequestHeadersToAdd, err = parseHeaders(conf.RequestHeadersToAdd); err != nil {
+		return merry.WithValue(err, "config", "envoy.headers.requestHeadersToAdd")
+	}
+
+	if routeConf.ResponseHeadersToAdd, err = parseHeaders(conf.ResponseHeadersToAdd); err != nil {
+		return merry.WithValue(err, "config", "envoy.headers.responseHeadersToAdd")
+	}
+
+	routeConf.RequestHeadersToRemove = conf.RequestHeadersToRemove
+	routeConf.ResponseHeadersToRemove = conf.ResponseHeadersToRemove
+
+	return nil
+}
+
+func getHeadersAnnotation(svc *corev1.Service, key string) ([]*core.HeaderValueOption, error) {
+	result, err := parseHeaders(svc.Annotations[key])
+
+	if err != nil {
+		return nil, newAnnotationError(svc, key).Append(err.Error())
+	}
+
+	return result, nil
+}
+
+// parseHeaders parses headers in the form of "<name>: <value>", one header per
+// line. Values can contain Envoy variables such as
+// "%DOWNSTREAM_REMOTE_ADDRESS%".
+func parseHeaders(s string) ([]*core.HeaderValueOption, error) {
+	var result []*core.HeaderValueOption
+
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		name := strings.TrimSpace(parts[0])
+
+		if len(parts) != 2 || name == "" {
+			return nil, ErrInvalidHeader.Here().WithValue("header", line)
+		}
+
+		result = append(result, newHeaderValueOption(name, strings.TrimSpace(parts[1])))
+	}
+
+	return result, nil
+}
+
+func newHeaderValueOption(name, value string) *core.HeaderValueOption {
+	return &core.HeaderValueOption{
+		Header: &core.HeaderValue{
+			Key:   name,
+			Value: value,
+		},
+	}
+}
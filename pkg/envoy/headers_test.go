@@ -0,0 +1,64 @@
+package envoy
+
+import (
+	"github.com/ansel1/merry"
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tommy351/kubenvoy/pkg/config"
+)
+
+var _ = Describe("setRouteHeaders", func() {
+	It("should set headers", func() {
+		r := new(route.Route)
+		Expect(setRouteHeaders(newTestService(map[string]string{
+			AnnotationRequestHeadersToAdd:     "x-client-ip: %DOWNSTREAM_REMOTE_ADDRESS%\nx-foo: a, b",
+			AnnotationRequestHeadersToRemove:  "x-internal",
+			AnnotationResponseHeadersToAdd:    "cache-control: no-cache",
+			AnnotationResponseHeadersToRemove: "server, x-powered-by",
+		}), r)).To(Succeed())
+		Expect(r.RequestHeadersToAdd).To(Equal([]*core.HeaderValueOption{
+			newHeaderValueOption("x-client-ip", "%DOWNSTREAM_REMOTE_ADDRESS%"),
+			newHeaderValueOption("x-foo", "a, b"),
+		}))
+		Expect(r.RequestHeadersToRemove).To(Equal([]string{"x-internal"}))
+		Expect(r.ResponseHeadersToAdd).To(Equal([]*core.HeaderValueOption{
+			newHeaderValueOption("cache-control", "no-cache"),
+		}))
+		Expect(r.ResponseHeadersToRemove).To(Equal([]string{"server", "x-powered-by"}))
+	})
+
+	It("should return an error when header is invalid", func() {
+		Expect(setRouteHeaders(newTestService(map[string]string{
+			AnnotationRequestHeadersToAdd: "x-foo",
+		}), new(route.Route))).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("setRouteConfigurationHeaders", func() {
+	It("should set headers", func() {
+		routeConf := new(api.RouteConfiguration)
+		Expect(setRouteConfigurationHeaders(&config.HeadersConfig{
+			RequestHeadersToAdd:     "x-b: 2\nx-a: 1",
+			ResponseHeadersToAdd:    "strict-transport-security: max-age=31536000",
+			ResponseHeadersToRemove: []string{"server"},
+		}, routeConf)).To(Succeed())
+		Expect(routeConf.RequestHeadersToAdd).To(Equal([]*core.HeaderValueOption{
+			newHeaderValueOption("x-b", "2"),
+			newHeaderValueOption("x-a", "1"),
+		}))
+		Expect(routeConf.ResponseHeadersToAdd).To(Equal([]*core.HeaderValueOption{
+			newHeaderValueOption("strict-transport-security", "max-age=31536000"),
+		}))
+		Expect(routeConf.ResponseHeadersToRemove).To(Equal([]string{"server"}))
+	})
+
+	It("should return an error when header is invalid", func() {
+		err := setRouteConfigurationHeaders(&config.HeadersConfig{
+			RequestHeadersToAdd: "x-foo",
+		}, new(api.RouteConfiguration))
+		Expect(merry.Is(err, ErrInvalidHeader)).To(BeTrue())
+	})
+})
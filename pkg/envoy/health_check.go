@@ -0,0 +1,165 @@
+package envoy
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/ansel1/merry"
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/gogo/protobuf/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	HealthCheckHTTP = "http"
+	HealthCheckTCP  = "tcp"
+
+	// HealthCheckGRPC switches the whole cluster to HTTP/2, because Envoy
+	// sends health checks with the protocol of the cluster. Requests of the
+	// service are sent over HTTP/2 as well, so it should only be used by gRPC
+	// services or upstreams accepting HTTP/2 without TLS.
+	HealthCheckGRPC = "grpc"
+)
+
+// setHealthChecks sets the health check of the cluster. gRPC health checks
+// enable HTTP/2 on the cluster as a side effect.
+func setHealthChecks(svc *corev1.Service, c *api.Cluster) error {
+	kind, ok := svc.Annotations[AnnotationHealthCheck]
+
+	if !ok {
+		return nil
+	}
+
+	hc := &core.HealthCheck{
+		Timeout:            durationPtr(DefaultHealthCheckTimeout),
+		Interval:           durationPtr(DefaultHealthCheckInterval),
+		HealthyThreshold:   &types.UInt32Value{Value: DefaultHealthyThreshold},
+		UnhealthyThreshold: &types.UInt32Value{Value: DefaultUnhealthyThreshold},
+	}
+
+	switch kind {
+	case HealthCheckHTTP:
+		checker, err := newHTTPHealthCheck(svc)
+
+		if err != nil {
+			return merry.Wrap(err)
+		}
+
+		hc.HealthChecker = &core.HealthCheck_HttpHealthCheck_{
+			HttpHealthCheck: checker,
+		}
+
+	case HealthCheckTCP:
+		hc.HealthChecker = &core.HealthCheck_TcpHealthCheck_{
+			TcpHealthCheck: &core.HealthCheck_TcpHealthCheck{},
+		}
+
+	case HealthCheckGRPC:
+		hc.HealthChecker = &core.HealthCheck_GrpcHealthCheck_{
+			GrpcHealthCheck: &core.HealthCheck_GrpcHealthCheck{},
+		}
+
+		// gRPC health checks are sent over HTTP/2, which is only possible
+		// when the cluster itself uses HTTP/2.
+		c.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
+
+	default:
+		return ErrInvalidHealthCheck.Here().
+			WithValue("service", svc.Name).
+			WithValue("type", kind)
+	}
+
+	if err := setHealthCheckOptions(svc, hc); err != nil {
+		return merry.Wrap(err)
+	}
+
+	c.HealthChecks = []*core.HealthCheck{hc}
+	return nil
+}
+
+func setHealthCheckOptions(svc *corev1.Service, hc *core.HealthCheck) error {
+	if d, err := getDurationAnnotation(svc, AnnotationHealthCheckTimeout); err != nil {
+		return merry.Wrap(err)
+	} else if d != nil {
+		hc.Timeout = d
+	}
+
+	if d, err := getDurationAnnotation(svc, AnnotationHealthCheckInterval); err != nil {
+		return merry.Wrap(err)
+	} else if d != nil {
+		hc.Interval = d
+	}
+
+	if v, err := getUint32Annotation(svc, AnnotationHealthyThreshold); err != nil {
+		return merry.Wrap(err)
+	} else if v != nil {
+		hc.HealthyThreshold = v
+	}
+
+	if v, err := getUint32Annotation(svc, AnnotationUnhealthyThreshold); err != nil {
+		return merry.Wrap(err)
+	} else if v != nil {
+		hc.UnhealthyThreshold = v
+	}
+
+	return nil
+}
+
+func newHTTPHealthCheck(svc *corev1.Service) (*core.HealthCheck_HttpHealthCheck, error) {
+	checker := &core.HealthCheck_HttpHealthCheck{
+		Path: DefaultHealthCheckPath,
+	}
+
+	if path := svc.Annotations[AnnotationHealthCheckPath]; path != "" {
+		checker.Path = path
+	}
+
+	for _, s := range getListAnnotation(svc, AnnotationHealthCheckExpectedStatuses) {
+		r, err := parseStatusRange(s)
+
+		if err != nil {
+			return nil, newAnnotationError(svc, AnnotationHealthCheckExpectedStatuses).Append(err.Error())
+		}
+
+		checker.ExpectedStatuses = append(checker.ExpectedStatuses, r)
+	}
+
+	return checker, nil
+}
+
+// parseStatusRange parses a status code (e.g. "200") or an inclusive range of
+// status codes (e.g. "200-299") into a half-open range.
+func parseStatusRange(s string) (*envoy_type.Int64Range, error) {
+	parts := strings.SplitN(s, "-", 2)
+	start, err := parseStatusCode(parts[0])
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	end := start
+
+	if len(parts) == 2 {
+		if end, err = parseStatusCode(parts[1]); err != nil {
+			return nil, merry.Wrap(err)
+		}
+	}
+
+	if end < start {
+		return nil, ErrInvalidStatusCode.Here().WithValue("code", s)
+	}
+
+	return &envoy_type.Int64Range{Start: start, End: end + 1}, nil
+}
+
+func parseStatusCode(s string) (int64, error) {
+	code, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+
+	if err != nil || code < 100 || code > 599 {
+		return 0, ErrInvalidStatusCode.Here().WithValue("code", s)
+	}
+
+	return code, nil
+}
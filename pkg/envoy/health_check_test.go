@@ -0,0 +1,108 @@
+package envoy
+
+import (
+	"time"
+
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/gogo/protobuf/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("setHealthChecks", func() {
+	var (
+		annotations map[string]string
+		c           *api.Cluster
+		err         error
+	)
+
+	BeforeEach(func() {
+		annotations = map[string]string{}
+		c = new(api.Cluster)
+	})
+
+	JustBeforeEach(func() {
+		err = setHealthChecks(newTestService(annotations), c)
+	})
+
+	It("should not set health checks by default", func() {
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.HealthChecks).To(BeEmpty())
+	})
+
+	Describe("given http health check", func() {
+		BeforeEach(func() {
+			annotations[AnnotationHealthCheck] = HealthCheckHTTP
+			annotations[AnnotationHealthCheckPath] = "/healthz"
+			annotations[AnnotationHealthCheckExpectedStatuses] = "200-299,404"
+			annotations[AnnotationHealthCheckInterval] = "500ms"
+			annotations[AnnotationUnhealthyThreshold] = "2"
+		})
+
+		It("should set health check", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.HealthChecks).To(Equal([]*core.HealthCheck{
+				{
+					Timeout:            durationPtr(DefaultHealthCheckTimeout),
+					Interval:           durationPtr(500 * time.Millisecond),
+					HealthyThreshold:   &types.UInt32Value{Value: DefaultHealthyThreshold},
+					UnhealthyThreshold: &types.UInt32Value{Value: 2},
+					HealthChecker: &core.HealthCheck_HttpHealthCheck_{
+						HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{
+							Path: "/healthz",
+							ExpectedStatuses: []*envoy_type.Int64Range{
+								{Start: 200, End: 300},
+								{Start: 404, End: 405},
+							},
+						},
+					},
+				},
+			}))
+		})
+	})
+
+	Describe("given tcp health check", func() {
+		BeforeEach(func() {
+			annotations[AnnotationHealthCheck] = HealthCheckTCP
+		})
+
+		It("should set health check", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.HealthChecks).To(HaveLen(1))
+			Expect(c.HealthChecks[0].HealthChecker).To(Equal(&core.HealthCheck_TcpHealthCheck_{
+				TcpHealthCheck: &core.HealthCheck_TcpHealthCheck{},
+			}))
+		})
+	})
+
+	Describe("given grpc health check", func() {
+		BeforeEach(func() {
+			annotations[AnnotationHealthCheck] = HealthCheckGRPC
+		})
+
+		It("should set health check", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.HealthChecks).To(HaveLen(1))
+			Expect(c.HealthChecks[0].HealthChecker).To(Equal(&core.HealthCheck_GrpcHealthCheck_{
+				GrpcHealthCheck: &core.HealthCheck_GrpcHealthCheck{},
+			}))
+		})
+
+		It("should enable HTTP/2", func() {
+			Expect(c.Http2ProtocolOptions).NotTo(BeNil())
+		})
+	})
+
+	DescribeTable("invalid annotations", func(annotations map[string]string) {
+		Expect(setHealthChecks(newTestService(annotations), new(api.Cluster))).NotTo(Succeed())
+	},
+		Entry("type", map[string]string{AnnotationHealthCheck: "udp"}),
+		Entry("interval", map[string]string{AnnotationHealthCheck: HealthCheckTCP, AnnotationHealthCheckInterval: "foo"}),
+		Entry("threshold", map[string]string{AnnotationHealthCheck: HealthCheckTCP, AnnotationHealthyThreshold: "foo"}),
+		Entry("expected statuses", map[string]string{AnnotationHealthCheck: HealthCheckHTTP, AnnotationHealthCheckExpectedStatuses: "299-200"}),
+		Entry("status out of range", map[string]string{AnnotationHealthCheck: HealthCheckHTTP, AnnotationHealthCheckExpectedStatuses: "700"}),
+	)
+})
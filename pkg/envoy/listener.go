@@ -0,0 +1,148 @@
+package envoy
+
+import (
+	"github.com/ansel1/merry"
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/tommy351/kubenvoy/pkg/config"
+)
+
+const httpListenerPort = 10000
+
+type httpListenerOptions struct {
+	RouteConfig *api.RouteConfiguration
+	Gzip        bool
+	Config      *config.EnvoyConfig
+}
+
+func newHTTPListener(options *httpListenerOptions) (*api.Listener, error) {
+	filters, err := newHTTPFilters(options)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	hcmConfig, err := util.MessageToStruct(&hcm.HttpConnectionManager{
+		CodecType:  hcm.AUTO,
+		StatPrefix: "http",
+		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
+			Rds: &hcm.Rds{
+				ConfigSource: core.ConfigSource{
+					ConfigSourceSpecifier: &core.ConfigSource_Ads{
+						Ads: &core.AggregatedConfigSource{},
+					},
+				},
+				RouteConfigName: options.RouteConfig.Name,
+			},
+		},
+		HttpFilters:    filters,
+		UpgradeConfigs: newUpgradeConfigs(options.RouteConfig, &options.Config.Upgrade),
+	})
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	return &api.Listener{
+		Name:    "kds",
+		Address: newListenerAddress(&options.Config.Listener, httpListenerPort),
+		FilterChains: []listener.FilterChain{
+			{
+				Filters: []listener.Filter{
+					{
+						Name: util.HTTPConnectionManager,
+						ConfigType: &listener.Filter_Config{
+							Config: hcmConfig,
+						},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// newListenerAddress returns the address listeners bind to. Dual-stack
+// listeners bind to "::" and accept IPv4 connections as IPv4-mapped IPv6
+// addresses.
+func newListenerAddress(conf *config.ListenerConfig, port uint32) core.Address {
+	if !conf.DualStack {
+		return *newSocketAddress("0.0.0.0", port)
+	}
+
+	addr := newSocketAddress("::", port)
+	addr.GetSocketAddress().Ipv4Compat = true
+
+	return *addr
+}
+
+// newHTTPFilters returns HTTP filters required by the routes. Filters are only
+// added when they are used, and the router filter is always the last one.
+func newHTTPFilters(options *httpListenerOptions) ([]*hcm.HttpFilter, error) {
+	var filters []*hcm.HttpFilter
+	routeConf := options.RouteConfig
+
+	if hasCorsPolicy(routeConf) {
+		filters = append(filters, &hcm.HttpFilter{Name: util.CORS})
+	}
+
+	if hasPerFilterConfig(routeConf, util.Fault) {
+		filters = append(filters, &hcm.HttpFilter{Name: util.Fault})
+	}
+
+	if options.Gzip && hasGzipDisabledRoutes(routeConf) {
+		f, err := newGzipCleanupFilter()
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		filters = append(filters, f)
+	}
+
+	if options.Gzip {
+		f, err := newGzipFilter(&options.Config.Gzip)
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		filters = append(filters, f)
+	}
+
+	return append(filters, &hcm.HttpFilter{Name: util.Router}), nil
+}
+
+func hasPerFilterConfig(routeConf *api.RouteConfiguration, name string) bool {
+	for _, vh := range routeConf.VirtualHosts {
+		if _, ok := vh.PerFilterConfig[name]; ok {
+			return true
+		}
+
+		for _, r := range vh.Routes {
+			if _, ok := r.PerFilterConfig[name]; ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func hasCorsPolicy(routeConf *api.RouteConfiguration) bool {
+	for _, vh := range routeConf.VirtualHosts {
+		if vh.Cors != nil {
+			return true
+		}
+
+		for i := range vh.Routes {
+			if action := vh.Routes[i].GetRoute(); action != nil && action.Cors != nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
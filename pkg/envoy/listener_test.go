@@ -0,0 +1,114 @@
+package envoy
+
+import (
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/gogo/protobuf/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tommy351/kubenvoy/pkg/config"
+)
+
+var _ = Describe("newHTTPFilters", func() {
+	It("should only contain the router by default", func() {
+		Expect(newHTTPFilters(&httpListenerOptions{RouteConfig: &api.RouteConfiguration{}})).To(Equal([]*hcm.HttpFilter{
+			{Name: util.Router},
+		}))
+	})
+
+	It("should add the fault filter when a route uses it", func() {
+		Expect(newHTTPFilters(&httpListenerOptions{RouteConfig: &api.RouteConfiguration{
+			VirtualHosts: []route.VirtualHost{
+				{
+					Routes: []route.Route{
+						{
+							PerFilterConfig: map[string]*types.Struct{
+								util.Fault: {},
+							},
+						},
+					},
+				},
+			},
+		}})).To(Equal([]*hcm.HttpFilter{
+			{Name: util.Fault},
+			{Name: util.Router},
+		}))
+	})
+
+	It("should add the CORS filter when a route has CORS policy", func() {
+		Expect(newHTTPFilters(&httpListenerOptions{RouteConfig: &api.RouteConfiguration{
+			VirtualHosts: []route.VirtualHost{
+				{
+					Routes: []route.Route{
+						{
+							Action: &route.Route_Route{
+								Route: &route.RouteAction{
+									Cors: &route.CorsPolicy{},
+								},
+							},
+						},
+					},
+				},
+			},
+		}})).To(Equal([]*hcm.HttpFilter{
+			{Name: util.CORS},
+			{Name: util.Router},
+		}))
+	})
+
+	It("should add the gzip filter when enabled", func() {
+		gzipFilter, err := newGzipFilter(&config.GzipConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(newHTTPFilters(&httpListenerOptions{
+			RouteConfig: &api.RouteConfiguration{},
+			Gzip:        true,
+			Config:      &config.EnvoyConfig{},
+		})).To(Equal([]*hcm.HttpFilter{
+			gzipFilter,
+			{Name: util.Router},
+		}))
+	})
+
+	It("should add the gzip cleanup filter before the gzip filter when routes opt out", func() {
+		routes := []route.Route{{Action: &route.Route_Route{Route: &route.RouteAction{}}}}
+		disableGzip(routes)
+		gzipFilter, err := newGzipFilter(&config.GzipConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		cleanupFilter, err := newGzipCleanupFilter()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(newHTTPFilters(&httpListenerOptions{
+			RouteConfig: &api.RouteConfiguration{
+				VirtualHosts: []route.VirtualHost{{Routes: routes}},
+			},
+			Gzip:   true,
+			Config: &config.EnvoyConfig{},
+		})).To(Equal([]*hcm.HttpFilter{
+			cleanupFilter,
+			gzipFilter,
+			{Name: util.Router},
+		}))
+	})
+})
+
+var _ = Describe("newListenerAddress", func() {
+	It("should bind to IPv4 by default", func() {
+		Expect(newListenerAddress(&config.ListenerConfig{}, 10000)).To(Equal(*newSocketAddress("0.0.0.0", 10000)))
+	})
+
+	It("should bind to IPv6 with IPv4 compatibility when dual-stack is enabled", func() {
+		Expect(newListenerAddress(&config.ListenerConfig{DualStack: true}, 10000)).To(Equal(core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Address: "::",
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: 10000,
+					},
+					Ipv4Compat: true,
+				},
+			},
+		}))
+	})
+})
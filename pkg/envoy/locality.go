@@ -0,0 +1,182 @@
+package envoy
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/ansel1/merry"
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/gogo/protobuf/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	LabelZone       = "topology.kubernetes.io/zone"
+	LabelRegion     = "topology.kubernetes.io/region"
+	LabelZoneBeta   = "failure-domain.beta.kubernetes.io/zone"
+	LabelRegionBeta = "failure-domain.beta.kubernetes.io/region"
+)
+
+// getNodeLocalities returns localities of nodes keyed by node names. Nodes
+// without zone and region labels are skipped.
+func getNodeLocalities(nodes cache.Store) map[string]*core.Locality {
+	result := map[string]*core.Locality{}
+
+	if nodes == nil {
+		return result
+	}
+
+	for _, obj := range nodes.List() {
+		node, ok := obj.(*corev1.Node)
+
+		if !ok {
+			continue
+		}
+
+		if locality := getNodeLocality(node); locality != nil {
+			result[node.Name] = locality
+		}
+	}
+
+	return result
+}
+
+// getNodeLocality returns the locality of a node. Beta labels are used for
+// nodes of clusters older than Kubernetes 1.17.
+func getNodeLocality(node *corev1.Node) *core.Locality {
+	region := getLabel(node.Labels, LabelRegion, LabelRegionBeta)
+	zone := getLabel(node.Labels, LabelZone, LabelZoneBeta)
+
+	if region == "" && zone == "" {
+		return nil
+	}
+
+	return &core.Locality{
+		Region: region,
+		Zone:   zone,
+	}
+}
+
+func getLabel(labels map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if v := labels[key]; v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+func getAddressLocality(addr *corev1.EndpointAddress, localities map[string]*core.Locality) *core.Locality {
+	if addr.NodeName == nil {
+		return nil
+	}
+
+	return localities[*addr.NodeName]
+}
+
+func getLocalityKey(locality *core.Locality) string {
+	if locality == nil {
+		return ""
+	}
+
+	return locality.Region + "/" + locality.Zone
+}
+
+// sortLocalityLbEndpoints sorts endpoints by priorities, regions and zones.
+// Endpoints without localities come first in the same priority.
+func sortLocalityLbEndpoints(endpoints []endpoint.LocalityLbEndpoints) {
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		if endpoints[i].Priority != endpoints[j].Priority {
+			return endpoints[i].Priority < endpoints[j].Priority
+		}
+
+		a, b := endpoints[i].Locality, endpoints[j].Locality
+
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+
+		if a.Region != b.Region {
+			return a.Region < b.Region
+		}
+
+		return a.Zone < b.Zone
+	})
+}
+
+func isZoneFailover(svc *corev1.Service) (bool, error) {
+	s, ok := svc.Annotations[AnnotationZoneFailover]
+
+	if !ok {
+		return false, nil
+	}
+
+	v, err := strconv.ParseBool(s)
+
+	if err != nil {
+		return false, newAnnotationError(svc, AnnotationZoneFailover).Append(err.Error())
+	}
+
+	return v, nil
+}
+
+// setLocalityPriorities lowers priorities of endpoints outside the zone of
+// Envoys, so Envoys only fail over to other zones when the local zone is
+// unhealthy. Endpoints without localities are considered to be in other zones.
+func setLocalityPriorities(svc *corev1.Service, local *core.Locality, endpoints []endpoint.LocalityLbEndpoints) error {
+	enabled, err := isZoneFailover(svc)
+
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	if !enabled || local == nil || local.Zone == "" {
+		return nil
+	}
+
+	for i := range endpoints {
+		if l := endpoints[i].Locality; l == nil || l.Region != local.Region || l.Zone != local.Zone {
+			endpoints[i].Priority = 1
+		}
+	}
+
+	return nil
+}
+
+// newZoneAwareLbConfig returns the zone-aware routing config set in
+// annotations. Zone-aware routing only works when Envoys report their own
+// localities and have a local cluster.
+func newZoneAwareLbConfig(svc *corev1.Service) (*api.Cluster_CommonLbConfig_ZoneAwareLbConfig, error) {
+	percent, err := getPercentAnnotation(svc, AnnotationZoneAwareRoutingPercent)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	minSize, err := getUint32Annotation(svc, AnnotationZoneAwareMinClusterSize)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if percent == nil && minSize == nil {
+		return nil, nil
+	}
+
+	result := new(api.Cluster_CommonLbConfig_ZoneAwareLbConfig)
+
+	if percent != nil {
+		result.RoutingEnabled = &envoy_type.Percent{Value: float64(percent.Value)}
+	}
+
+	if minSize != nil {
+		result.MinClusterSize = &types.UInt64Value{Value: uint64(minSize.Value)}
+	}
+
+	return result, nil
+}
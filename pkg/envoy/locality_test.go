@@ -0,0 +1,188 @@
+package envoy
+
+import (
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/gogo/protobuf/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestNode(name string, labels map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+var _ = Describe("getNodeLocalities", func() {
+	It("should return an empty map without nodes", func() {
+		Expect(getNodeLocalities(nil)).To(BeEmpty())
+	})
+
+	It("should read zone and region labels", func() {
+		nodes := cache.NewStore(cache.MetaNamespaceKeyFunc)
+		Expect(nodes.Add(newTestNode("a", map[string]string{
+			LabelRegion: "us-east1",
+			LabelZone:   "us-east1-b",
+		}))).To(Succeed())
+		Expect(nodes.Add(newTestNode("b", map[string]string{
+			LabelRegionBeta: "us-east1",
+			LabelZoneBeta:   "us-east1-c",
+		}))).To(Succeed())
+		Expect(nodes.Add(newTestNode("c", map[string]string{}))).To(Succeed())
+
+		Expect(getNodeLocalities(nodes)).To(Equal(map[string]*core.Locality{
+			"a": {Region: "us-east1", Zone: "us-east1-b"},
+			"b": {Region: "us-east1", Zone: "us-east1-c"},
+		}))
+	})
+})
+
+var _ = Describe("newClusterLoadAssignment", func() {
+	newLbEndpoint := func(ip string) endpoint.LbEndpoint {
+		return endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{
+					Address: newSocketAddress(ip, 80),
+				},
+			},
+		}
+	}
+
+	It("should group addresses by localities", func() {
+		zoneB := &core.Locality{Region: "us-east1", Zone: "us-east1-b"}
+		zoneC := &core.Locality{Region: "us-east1", Zone: "us-east1-c"}
+		cla, err := newClusterLoadAssignment(&loadAssignmentOptions{
+			Name:    "foo",
+			Service: newTestService(map[string]string{}),
+			Endpoints: &corev1.Endpoints{
+				Subsets: []corev1.EndpointSubset{
+					{
+						Addresses: []corev1.EndpointAddress{
+							{IP: "10.1.1.0", NodeName: stringPtr("c")},
+							{IP: "10.1.1.1", NodeName: stringPtr("b")},
+							{IP: "10.1.1.2"},
+							{IP: "10.1.1.3", NodeName: stringPtr("c")},
+						},
+						Ports: []corev1.EndpointPort{
+							{Port: 80},
+						},
+					},
+				},
+			},
+			Localities: map[string]*core.Locality{
+				"b": zoneB,
+				"c": zoneC,
+			},
+		})
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cla.Endpoints).To(Equal([]endpoint.LocalityLbEndpoints{
+			{
+				LbEndpoints: []endpoint.LbEndpoint{newLbEndpoint("10.1.1.2")},
+			},
+			{
+				Locality:    zoneB,
+				LbEndpoints: []endpoint.LbEndpoint{newLbEndpoint("10.1.1.1")},
+			},
+			{
+				Locality:    zoneC,
+				LbEndpoints: []endpoint.LbEndpoint{newLbEndpoint("10.1.1.0"), newLbEndpoint("10.1.1.3")},
+			},
+		}))
+	})
+})
+
+var _ = Describe("setLocalityPriorities", func() {
+	local := &core.Locality{Region: "us-east1", Zone: "us-east1-b"}
+	var endpoints []endpoint.LocalityLbEndpoints
+
+	BeforeEach(func() {
+		endpoints = []endpoint.LocalityLbEndpoints{
+			{},
+			{Locality: &core.Locality{Region: "us-east1", Zone: "us-east1-b"}},
+			{Locality: &core.Locality{Region: "us-east1", Zone: "us-east1-c"}},
+		}
+	})
+
+	getPriorities := func() []uint32 {
+		var result []uint32
+
+		for _, ep := range endpoints {
+			result = append(result, ep.Priority)
+		}
+
+		return result
+	}
+
+	It("should not set priorities by default", func() {
+		Expect(setLocalityPriorities(newTestService(map[string]string{}), local, endpoints)).To(Succeed())
+		Expect(getPriorities()).To(Equal([]uint32{0, 0, 0}))
+	})
+
+	It("should lower priorities of other zones when enabled", func() {
+		Expect(setLocalityPriorities(newTestService(map[string]string{
+			AnnotationZoneFailover: "true",
+		}), local, endpoints)).To(Succeed())
+		Expect(getPriorities()).To(Equal([]uint32{1, 0, 1}))
+	})
+
+	It("should not set priorities when the locality of Envoys is unknown", func() {
+		Expect(setLocalityPriorities(newTestService(map[string]string{
+			AnnotationZoneFailover: "true",
+		}), nil, endpoints)).To(Succeed())
+		Expect(getPriorities()).To(Equal([]uint32{0, 0, 0}))
+	})
+
+	It("should return an error when the annotation is invalid", func() {
+		Expect(setLocalityPriorities(newTestService(map[string]string{
+			AnnotationZoneFailover: "foo",
+		}), local, endpoints)).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("sortLocalityLbEndpoints", func() {
+	It("should sort by priorities first", func() {
+		zoneB := endpoint.LocalityLbEndpoints{Locality: &core.Locality{Zone: "b"}}
+		zoneC := endpoint.LocalityLbEndpoints{Locality: &core.Locality{Zone: "c"}, Priority: 1}
+		zoneA := endpoint.LocalityLbEndpoints{Locality: &core.Locality{Zone: "a"}, Priority: 1}
+		endpoints := []endpoint.LocalityLbEndpoints{zoneC, zoneA, zoneB}
+		sortLocalityLbEndpoints(endpoints)
+		Expect(endpoints).To(Equal([]endpoint.LocalityLbEndpoints{zoneB, zoneA, zoneC}))
+	})
+})
+
+var _ = Describe("newZoneAwareLbConfig", func() {
+	It("should return nil by default", func() {
+		Expect(newZoneAwareLbConfig(newTestService(map[string]string{}))).To(BeNil())
+	})
+
+	It("should set config from annotations", func() {
+		Expect(newZoneAwareLbConfig(newTestService(map[string]string{
+			AnnotationZoneAwareRoutingPercent: "50",
+			AnnotationZoneAwareMinClusterSize: "3",
+		}))).To(Equal(&api.Cluster_CommonLbConfig_ZoneAwareLbConfig{
+			RoutingEnabled: &envoy_type.Percent{Value: 50},
+			MinClusterSize: &types.UInt64Value{Value: 3},
+		}))
+	})
+
+	It("should return an error when the percentage is invalid", func() {
+		_, err := newZoneAwareLbConfig(newTestService(map[string]string{
+			AnnotationZoneAwareRoutingPercent: "101",
+		}))
+		Expect(err).To(HaveOccurred())
+	})
+})
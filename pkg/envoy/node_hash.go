@@ -2,12 +2,31 @@ package envoy
 
 import "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 
-type NodeHash struct{}
+// NodeHash groups Envoys by their IDs. Envoys are grouped by zones as well when
+// Localities is enabled, because snapshots are only built for zones of Envoys
+// in that case.
+type NodeHash struct {
+	Localities bool
+}
 
-func (NodeHash) ID(node *core.Node) string {
+func (h NodeHash) ID(node *core.Node) string {
 	if node == nil {
 		return "unknown"
 	}
 
-	return node.Id
+	if !h.Localities {
+		return node.Id
+	}
+
+	return NodeGroup(node.Id, node.Locality)
+}
+
+// NodeGroup returns the key of snapshots shared by Envoys with the same ID in
+// the same zone, so endpoints can be prioritized by zones of Envoys.
+func NodeGroup(id string, locality *core.Locality) string {
+	if locality == nil || locality.Zone == "" {
+		return id
+	}
+
+	return id + "/" + locality.Region + "/" + locality.Zone
 }
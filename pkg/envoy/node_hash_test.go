@@ -9,10 +9,26 @@ import (
 
 var _ = Describe("NodeHash", func() {
 	DescribeTable("ID", func(expected string, node *core.Node) {
-		hash := NodeHash{}
+		hash := NodeHash{Localities: true}
 		Expect(hash.ID(node)).To(Equal(expected))
 	},
 		Entry("unknown", "unknown", nil),
 		Entry("id", "foo", &core.Node{Id: "foo"}),
+		Entry("zone", "foo/us-east1/us-east1-b", &core.Node{
+			Id:       "foo",
+			Locality: &core.Locality{Region: "us-east1", Zone: "us-east1-b"},
+		}),
+		Entry("region only", "foo", &core.Node{
+			Id:       "foo",
+			Locality: &core.Locality{Region: "us-east1"},
+		}),
 	)
+
+	It("should ignore zones when localities are disabled", func() {
+		hash := NodeHash{}
+		Expect(hash.ID(&core.Node{
+			Id:       "foo",
+			Locality: &core.Locality{Region: "us-east1", Zone: "us-east1-b"},
+		})).To(Equal("foo"))
+	})
 })
@@ -0,0 +1,116 @@
+package envoy
+
+import (
+	"strconv"
+
+	"github.com/ansel1/merry"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// hasBackend returns false if routes of the service are responded by Envoy
+// directly, so the service doesn't need a cluster.
+func hasBackend(svc *corev1.Service) bool {
+	for _, key := range []string{
+		AnnotationRedirectHost,
+		AnnotationRedirectPath,
+		AnnotationHTTPSRedirect,
+		AnnotationDirectResponseStatus,
+	} {
+		if _, ok := svc.Annotations[key]; ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRedirectAction(svc *corev1.Service) (*route.RedirectAction, error) {
+	host, hasHost := svc.Annotations[AnnotationRedirectHost]
+	path, hasPath := svc.Annotations[AnnotationRedirectPath]
+	https, hasHTTPS := svc.Annotations[AnnotationHTTPSRedirect]
+
+	if !hasHost && !hasPath && !hasHTTPS {
+		return nil, nil
+	}
+
+	action := &route.RedirectAction{
+		HostRedirect: host,
+	}
+
+	if path != "" {
+		action.PathRewriteSpecifier = &route.RedirectAction_PathRedirect{
+			PathRedirect: path,
+		}
+	}
+
+	if hasHTTPS {
+		v, err := strconv.ParseBool(https)
+
+		if err != nil {
+			return nil, newAnnotationError(svc, AnnotationHTTPSRedirect).Append(err.Error())
+		}
+
+		action.SchemeRewriteSpecifier = &route.RedirectAction_HttpsRedirect{
+			HttpsRedirect: v,
+		}
+	}
+
+	if s, ok := svc.Annotations[AnnotationRedirectCode]; ok {
+		code, err := getRedirectResponseCode(s)
+
+		if err != nil {
+			return nil, merry.WithValue(err, "service", svc.Name)
+		}
+
+		action.ResponseCode = code
+	}
+
+	return action, nil
+}
+
+func getRedirectResponseCode(s string) (route.RedirectAction_RedirectResponseCode, error) {
+	switch s {
+	case "301":
+		return route.RedirectAction_MOVED_PERMANENTLY, nil
+	case "302":
+		return route.RedirectAction_FOUND, nil
+	case "303":
+		return route.RedirectAction_SEE_OTHER, nil
+	case "307":
+		return route.RedirectAction_TEMPORARY_REDIRECT, nil
+	case "308":
+		return route.RedirectAction_PERMANENT_REDIRECT, nil
+	}
+
+	return 0, ErrInvalidStatusCode.Here().WithValue("code", s)
+}
+
+func newDirectResponseAction(svc *corev1.Service) (*route.DirectResponseAction, error) {
+	s, ok := svc.Annotations[AnnotationDirectResponseStatus]
+
+	if !ok {
+		return nil, nil
+	}
+
+	status, err := parseStatusCode(s)
+
+	if err != nil {
+		return nil, merry.WithValue(err, "service", svc.Name)
+	}
+
+	action := &route.DirectResponseAction{
+		Status: uint32(status),
+	}
+
+	if body, ok := svc.Annotations[AnnotationDirectResponseBody]; ok {
+		action.Body = &core.DataSource{
+			Specifier: &core.DataSource_InlineString{
+				InlineString: body,
+			},
+		}
+	}
+
+	return action, nil
+}
@@ -0,0 +1,78 @@
+package envoy
+
+import (
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("setRouteAction", func() {
+	newTestRoute := func(annotations map[string]string) (*route.Route, error) {
+		r := new(route.Route)
+		return r, setRouteAction(newTestService(annotations), nil, r)
+	}
+
+	It("should redirect", func() {
+		r, err := newTestRoute(map[string]string{
+			AnnotationRedirectHost:  "example.com",
+			AnnotationRedirectPath:  "/new",
+			AnnotationRedirectCode:  "308",
+			AnnotationHTTPSRedirect: "true",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Action).To(Equal(&route.Route_Redirect{
+			Redirect: &route.RedirectAction{
+				HostRedirect: "example.com",
+				PathRewriteSpecifier: &route.RedirectAction_PathRedirect{
+					PathRedirect: "/new",
+				},
+				SchemeRewriteSpecifier: &route.RedirectAction_HttpsRedirect{
+					HttpsRedirect: true,
+				},
+				ResponseCode: route.RedirectAction_PERMANENT_REDIRECT,
+			},
+		}))
+	})
+
+	It("should respond directly", func() {
+		r, err := newTestRoute(map[string]string{
+			AnnotationDirectResponseStatus: "200",
+			AnnotationDirectResponseBody:   "User-agent: *\nDisallow: /",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Action).To(Equal(&route.Route_DirectResponse{
+			DirectResponse: &route.DirectResponseAction{
+				Status: 200,
+				Body: &core.DataSource{
+					Specifier: &core.DataSource_InlineString{
+						InlineString: "User-agent: *\nDisallow: /",
+					},
+				},
+			},
+		}))
+	})
+
+	It("should respond without body", func() {
+		r, err := newTestRoute(map[string]string{
+			AnnotationDirectResponseStatus: "410",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Action).To(Equal(&route.Route_DirectResponse{
+			DirectResponse: &route.DirectResponseAction{
+				Status: 410,
+			},
+		}))
+	})
+
+	DescribeTable("invalid annotations", func(annotations map[string]string) {
+		_, err := newTestRoute(annotations)
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("redirect code", map[string]string{AnnotationRedirectHost: "example.com", AnnotationRedirectCode: "200"}),
+		Entry("https redirect", map[string]string{AnnotationHTTPSRedirect: "foo"}),
+		Entry("direct response status", map[string]string{AnnotationDirectResponseStatus: "foo"}),
+		Entry("redirect with direct response", map[string]string{AnnotationRedirectHost: "example.com", AnnotationDirectResponseStatus: "200"}),
+	)
+})
@@ -0,0 +1,632 @@
+package envoy
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/gogo/protobuf/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	HashPolicyHeader   = "header"
+	HashPolicyCookie   = "cookie"
+	HashPolicySourceIP = "source_ip"
+
+	retryOnRetriableStatusCodes = "retriable-status-codes"
+)
+
+// newRoutes returns a route for each path prefix of a service.
+func newRoutes(svc *corev1.Service, clusters map[string]bool) ([]route.Route, error) {
+	var routes []route.Route
+	paths := getListAnnotation(svc, AnnotationPaths)
+
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, newAnnotationError(svc, AnnotationPaths).Append("path must start with /")
+		}
+
+		r, err := newRoute(svc, clusters, path)
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		routes = append(routes, *r)
+	}
+
+	return routes, nil
+}
+
+func newRoute(svc *corev1.Service, clusters map[string]bool, prefix string) (*route.Route, error) {
+	match, err := newRouteMatch(svc, prefix)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	r := &route.Route{
+		Match: *match,
+	}
+
+	if err := setRouteAction(svc, clusters, r); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if action := r.GetRoute(); action != nil {
+		if action.PrefixRewrite, err = getPrefixRewrite(svc, prefix); err != nil {
+			return nil, merry.Wrap(err)
+		}
+	}
+
+	if err := setRouteHeaders(svc, r); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if err := setPerFilterConfig(svc, r); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	return r, nil
+}
+
+// setRouteAction sets a redirect or a direct response if the service has
+// one, otherwise the route is sent to the clusters.
+func setRouteAction(svc *corev1.Service, clusters map[string]bool, r *route.Route) error {
+	redirect, err := newRedirectAction(svc)
+
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	direct, err := newDirectResponseAction(svc)
+
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	switch {
+	case redirect != nil && direct != nil:
+		return ErrConflictAnnotations.Here().
+			WithValue("service", svc.Name).
+			WithValue("annotations", []string{AnnotationRedirectHost, AnnotationDirectResponseStatus})
+
+	case redirect != nil:
+		r.Action = &route.Route_Redirect{Redirect: redirect}
+
+	case direct != nil:
+		r.Action = &route.Route_DirectResponse{DirectResponse: direct}
+
+	default:
+		action, err := newRouteAction(svc, clusters)
+
+		if err != nil {
+			return merry.Wrap(err)
+		}
+
+		r.Action = &route.Route_Route{Route: action}
+	}
+
+	return nil
+}
+
+func newRouteAction(svc *corev1.Service, clusters map[string]bool) (*route.RouteAction, error) {
+	action := new(route.RouteAction)
+
+	if err := setRouteClusters(svc, clusters, action); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if err := setRouteRewrites(svc, action); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if err := setRouteTimeouts(svc, action); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	policy, err := newRetryPolicy(svc)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	action.RetryPolicy = policy
+
+	if action.HashPolicy, err = newHashPolicies(svc); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if action.RequestMirrorPolicy, err = newRequestMirrorPolicy(svc, clusters); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if action.Cors, err = newCorsPolicy(svc); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	return action, nil
+}
+
+func setPerFilterConfig(svc *corev1.Service, r *route.Route) error {
+	faultConf, err := newFaultConfig(svc)
+
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	if faultConf != nil {
+		r.PerFilterConfig = map[string]*types.Struct{
+			util.Fault: faultConf,
+		}
+	}
+
+	return nil
+}
+
+func newRouteMatch(svc *corev1.Service, prefix string) (*route.RouteMatch, error) {
+	match := &route.RouteMatch{
+		PathSpecifier: &route.RouteMatch_Prefix{
+			Prefix: prefix,
+		},
+	}
+
+	for _, s := range getLinesAnnotation(svc, AnnotationMatchHeaders) {
+		m, err := newHeaderMatcher(s)
+
+		if err != nil {
+			return nil, merry.WithValue(err, "service", svc.Name)
+		}
+
+		match.Headers = append(match.Headers, m)
+	}
+
+	for _, s := range getLinesAnnotation(svc, AnnotationMatchQuery) {
+		m, err := newQueryParameterMatcher(s)
+
+		if err != nil {
+			return nil, merry.WithValue(err, "service", svc.Name)
+		}
+
+		match.QueryParameters = append(match.QueryParameters, m)
+	}
+
+	return match, nil
+}
+
+// parseMatcher parses a matcher in the form of "<name>=<value>" (exact),
+// "<name>~=<regex>" (regex) or "<name>" (present).
+func parseMatcher(s string) (name, value string, regex bool, err error) {
+	if i := strings.Index(s, "="); i >= 0 {
+		name, value = s[:i], s[i+1:]
+
+		if strings.HasSuffix(name, "~") {
+			name = strings.TrimSuffix(name, "~")
+			regex = true
+
+			if _, err := regexp.Compile(value); err != nil {
+				return "", "", false, ErrInvalidMatcher.Here().WithValue("matcher", s).Append(err.Error())
+			}
+		}
+	} else {
+		name = s
+	}
+
+	if name = strings.TrimSpace(name); name == "" {
+		return "", "", false, ErrInvalidMatcher.Here().WithValue("matcher", s)
+	}
+
+	return name, value, regex, nil
+}
+
+func newHeaderMatcher(s string) (*route.HeaderMatcher, error) {
+	name, value, regex, err := parseMatcher(s)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	m := &route.HeaderMatcher{Name: name}
+
+	switch {
+	case regex:
+		m.HeaderMatchSpecifier = &route.HeaderMatcher_RegexMatch{RegexMatch: value}
+	case strings.Contains(s, "="):
+		m.HeaderMatchSpecifier = &route.HeaderMatcher_ExactMatch{ExactMatch: value}
+	default:
+		m.HeaderMatchSpecifier = &route.HeaderMatcher_PresentMatch{PresentMatch: true}
+	}
+
+	return m, nil
+}
+
+func newQueryParameterMatcher(s string) (*route.QueryParameterMatcher, error) {
+	name, value, regex, err := parseMatcher(s)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	// Query parameters without values match requests containing the key.
+	m := &route.QueryParameterMatcher{
+		Name:  name,
+		Value: value,
+	}
+
+	if regex {
+		m.Regex = &types.BoolValue{Value: true}
+	}
+
+	return m, nil
+}
+
+// sortRoutes moves routes with longer path prefixes, and then routes with
+// header or query parameter matchers, ahead of catch-all routes, because Envoy
+// uses the first matched route.
+func sortRoutes(routes []route.Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := &routes[i].Match, &routes[j].Match
+
+		if pa, pb := len(a.GetPrefix()), len(b.GetPrefix()); pa != pb {
+			return pa > pb
+		}
+
+		return countMatchers(a) > countMatchers(b)
+	})
+}
+
+func countMatchers(match *route.RouteMatch) int {
+	return len(match.Headers) + len(match.QueryParameters)
+}
+
+func setRouteClusters(svc *corev1.Service, clusters map[string]bool, action *route.RouteAction) error {
+	weights, err := getTrafficSplit(svc)
+
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	if len(weights) == 0 {
+		action.ClusterSpecifier = &route.RouteAction_Cluster{
+			Cluster: svc.Name,
+		}
+
+		return nil
+	}
+
+	// The rest of traffic is sent to the service itself.
+	remaining := uint32(100)
+
+	for _, w := range weights {
+		if !clusters[w.Name] {
+			return ErrClusterNotFound.Here().
+				WithValue("service", svc.Name).
+				WithValue("cluster", w.Name)
+		}
+
+		remaining -= w.Weight.Value
+	}
+
+	action.ClusterSpecifier = &route.RouteAction_WeightedClusters{
+		WeightedClusters: &route.WeightedCluster{
+			Clusters: append([]*route.WeightedCluster_ClusterWeight{
+				{
+					Name:   svc.Name,
+					Weight: &types.UInt32Value{Value: remaining},
+				},
+			}, weights...),
+		},
+	}
+
+	return nil
+}
+
+// getTrafficSplit parses the traffic split annotation in the form of
+// "<service>=<percentage>,...".
+func getTrafficSplit(svc *corev1.Service) ([]*route.WeightedCluster_ClusterWeight, error) {
+	var (
+		result []*route.WeightedCluster_ClusterWeight
+		total  uint64
+	)
+
+	for _, s := range getListAnnotation(svc, AnnotationTrafficSplit) {
+		parts := strings.SplitN(s, "=", 2)
+		name := strings.TrimSpace(parts[0])
+
+		if len(parts) != 2 || name == "" || name == svc.Name {
+			return nil, newTrafficSplitError(svc, s)
+		}
+
+		weight, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+
+		if err != nil {
+			return nil, newTrafficSplitError(svc, s)
+		}
+
+		if total += weight; total > 100 {
+			return nil, newTrafficSplitError(svc, s).Append("total weight exceeds 100")
+		}
+
+		result = append(result, &route.WeightedCluster_ClusterWeight{
+			Name:   name,
+			Weight: &types.UInt32Value{Value: uint32(weight)},
+		})
+	}
+
+	return result, nil
+}
+
+func newTrafficSplitError(svc *corev1.Service, value string) merry.Error {
+	return ErrInvalidTrafficSplit.Here().
+		WithValue("service", svc.Name).
+		WithValue("value", value)
+}
+
+func newRequestMirrorPolicy(svc *corev1.Service, clusters map[string]bool) (*route.RouteAction_RequestMirrorPolicy, error) {
+	name := svc.Annotations[AnnotationMirror]
+
+	if name == "" {
+		return nil, nil
+	}
+
+	if !clusters[name] {
+		return nil, ErrClusterNotFound.Here().
+			WithValue("service", svc.Name).
+			WithValue("cluster", name)
+	}
+
+	percent, err := getPercentAnnotation(svc, AnnotationMirrorPercent)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	policy := &route.RouteAction_RequestMirrorPolicy{
+		Cluster: name,
+	}
+
+	if percent != nil {
+		policy.RuntimeFraction = &core.RuntimeFractionalPercent{
+			DefaultValue: &envoy_type.FractionalPercent{
+				Numerator:   percent.Value,
+				Denominator: envoy_type.FractionalPercent_HUNDRED,
+			},
+		}
+	}
+
+	return policy, nil
+}
+
+// getPrefixRewrite returns the rewrite of the path prefix. Rewrites are
+// separated by commas, one for each path in the same order, because a rewrite
+// replaces the matched prefix and can't be shared by different prefixes.
+func getPrefixRewrite(svc *corev1.Service, prefix string) (string, error) {
+	rewrites := getListAnnotation(svc, AnnotationPrefixRewrite)
+
+	if len(rewrites) == 0 {
+		return "", nil
+	}
+
+	paths := getListAnnotation(svc, AnnotationPaths)
+
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+
+	if len(rewrites) != len(paths) {
+		return "", newAnnotationError(svc, AnnotationPrefixRewrite).Append("a rewrite is required for each path")
+	}
+
+	for i, path := range paths {
+		if path == prefix {
+			return rewrites[i], nil
+		}
+	}
+
+	return "", nil
+}
+
+func setRouteRewrites(svc *corev1.Service, action *route.RouteAction) error {
+	host := svc.Annotations[AnnotationHostRewrite]
+	auto := svc.Annotations[AnnotationAutoHostRewrite]
+
+	if host != "" && auto != "" {
+		return ErrConflictAnnotations.Here().
+			WithValue("service", svc.Name).
+			WithValue("annotations", []string{AnnotationHostRewrite, AnnotationAutoHostRewrite})
+	}
+
+	if host != "" {
+		action.HostRewriteSpecifier = &route.RouteAction_HostRewrite{
+			HostRewrite: host,
+		}
+	}
+
+	if auto != "" {
+		v, err := strconv.ParseBool(auto)
+
+		if err != nil {
+			return newAnnotationError(svc, AnnotationAutoHostRewrite).Append(err.Error())
+		}
+
+		action.HostRewriteSpecifier = &route.RouteAction_AutoHostRewrite{
+			AutoHostRewrite: &types.BoolValue{Value: v},
+		}
+	}
+
+	return nil
+}
+
+func setRouteTimeouts(svc *corev1.Service, action *route.RouteAction) (err error) {
+	if action.Timeout, err = getDurationAnnotation(svc, AnnotationTimeout); err != nil {
+		return merry.Wrap(err)
+	}
+
+	if action.IdleTimeout, err = getDurationAnnotation(svc, AnnotationIdleTimeout); err != nil {
+		return merry.Wrap(err)
+	}
+
+	return nil
+}
+
+func newRetryPolicy(svc *corev1.Service) (*route.RetryPolicy, error) {
+	var err error
+	policy := new(route.RetryPolicy)
+
+	if policy.NumRetries, err = getUint32Annotation(svc, AnnotationRetries); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if policy.PerTryTimeout, err = getDurationAnnotation(svc, AnnotationPerTryTimeout); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	conditions := getListAnnotation(svc, AnnotationRetryOn)
+
+	for _, c := range conditions {
+		if !isValidRetryOn(c) {
+			return nil, ErrInvalidRetryOn.Here().
+				WithValue("service", svc.Name).
+				WithValue("condition", c)
+		}
+	}
+
+	for _, s := range getListAnnotation(svc, AnnotationRetriableStatusCodes) {
+		code, err := parseStatusCode(s)
+
+		if err != nil {
+			return nil, merry.WithValue(err, "service", svc.Name)
+		}
+
+		policy.RetriableStatusCodes = append(policy.RetriableStatusCodes, uint32(code))
+	}
+
+	// Status codes are only checked when the retriable-status-codes
+	// condition is enabled.
+	if len(policy.RetriableStatusCodes) > 0 && !containsString(conditions, retryOnRetriableStatusCodes) {
+		conditions = append(conditions, retryOnRetriableStatusCodes)
+	}
+
+	policy.RetryOn = strings.Join(conditions, ",")
+
+	if policy.RetryOn == "" {
+		if policy.NumRetries != nil || policy.PerTryTimeout != nil {
+			return nil, ErrNoRetryOn.Here().WithValue("service", svc.Name)
+		}
+
+		return nil, nil
+	}
+
+	return policy, nil
+}
+
+// newHashPolicies parses hash policies in the form of "header:<name>",
+// "cookie:<name>" or "source_ip". Services with client IP session affinity
+// are hashed by source IP when no hash policies are given.
+func newHashPolicies(svc *corev1.Service) ([]*route.RouteAction_HashPolicy, error) {
+	var policies []*route.RouteAction_HashPolicy
+
+	ttl, err := getDurationAnnotation(svc, AnnotationHashCookieTTL)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	for _, s := range getListAnnotation(svc, AnnotationHashPolicy) {
+		policy, err := newHashPolicy(s, ttl)
+
+		if err != nil {
+			return nil, merry.WithValue(err, "service", svc.Name)
+		}
+
+		policies = append(policies, policy)
+	}
+
+	if len(policies) == 0 && svc.Spec.SessionAffinity == corev1.ServiceAffinityClientIP {
+		policies = append(policies, newSourceIPHashPolicy())
+	}
+
+	return policies, nil
+}
+
+func newHashPolicy(s string, cookieTTL *time.Duration) (*route.RouteAction_HashPolicy, error) {
+	parts := strings.SplitN(s, ":", 2)
+	kind := parts[0]
+	name := ""
+
+	if len(parts) == 2 {
+		name = strings.TrimSpace(parts[1])
+	}
+
+	switch {
+	case kind == HashPolicyHeader && name != "":
+		return &route.RouteAction_HashPolicy{
+			PolicySpecifier: &route.RouteAction_HashPolicy_Header_{
+				Header: &route.RouteAction_HashPolicy_Header{
+					HeaderName: name,
+				},
+			},
+		}, nil
+
+	case kind == HashPolicyCookie && name != "":
+		return &route.RouteAction_HashPolicy{
+			PolicySpecifier: &route.RouteAction_HashPolicy_Cookie_{
+				Cookie: &route.RouteAction_HashPolicy_Cookie{
+					Name: name,
+					Ttl:  cookieTTL,
+				},
+			},
+		}, nil
+
+	case kind == HashPolicySourceIP && len(parts) == 1:
+		return newSourceIPHashPolicy(), nil
+	}
+
+	return nil, ErrInvalidHashPolicy.Here().WithValue("policy", s)
+}
+
+func newSourceIPHashPolicy() *route.RouteAction_HashPolicy {
+	return &route.RouteAction_HashPolicy{
+		PolicySpecifier: &route.RouteAction_HashPolicy_ConnectionProperties_{
+			ConnectionProperties: &route.RouteAction_HashPolicy_ConnectionProperties{
+				SourceIp: true,
+			},
+		},
+	}
+}
+
+func isValidRetryOn(s string) bool {
+	switch s {
+	// HTTP conditions
+	case "5xx", "gateway-error", "connect-failure", "retriable-4xx", "refused-stream", retryOnRetriableStatusCodes:
+		return true
+
+	// gRPC conditions
+	case "cancelled", "deadline-exceeded", "internal", "resource-exhausted", "unavailable":
+		return true
+	}
+
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
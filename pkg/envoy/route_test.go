@@ -0,0 +1,394 @@
+package envoy
+
+import (
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/gogo/protobuf/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestService(annotations map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Annotations: annotations,
+		},
+	}
+}
+
+func mustNewRouteAction(annotations map[string]string) *route.RouteAction {
+	r, err := newRoute(newTestService(annotations), nil, "/")
+	Expect(err).NotTo(HaveOccurred())
+	return r.Action.(*route.Route_Route).Route
+}
+
+var _ = Describe("sortRoutes", func() {
+	It("should move routes with matchers ahead of catch-all routes", func() {
+		catchAll := route.Route{}
+		header := route.Route{
+			Match: route.RouteMatch{
+				Headers: []*route.HeaderMatcher{{Name: "x-version"}},
+			},
+		}
+		query := route.Route{
+			Match: route.RouteMatch{
+				QueryParameters: []*route.QueryParameterMatcher{{Name: "version"}},
+			},
+		}
+		routes := []route.Route{catchAll, header, query}
+		sortRoutes(routes)
+		Expect(routes).To(Equal([]route.Route{header, query, catchAll}))
+	})
+
+	It("should move routes with longer prefixes ahead", func() {
+		newPrefixRoute := func(prefix string) route.Route {
+			return route.Route{
+				Match: route.RouteMatch{
+					PathSpecifier: &route.RouteMatch_Prefix{Prefix: prefix},
+				},
+			}
+		}
+		root := newPrefixRoute("/")
+		billing := newPrefixRoute("/billing")
+		routes := []route.Route{root, billing}
+		sortRoutes(routes)
+		Expect(routes).To(Equal([]route.Route{billing, root}))
+	})
+})
+
+var _ = Describe("newRoutes", func() {
+	It("should match all paths by default", func() {
+		routes, err := newRoutes(newTestService(map[string]string{}), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).To(HaveLen(1))
+		Expect(routes[0].Match.GetPrefix()).To(Equal("/"))
+	})
+
+	It("should create a route for each path", func() {
+		routes, err := newRoutes(newTestService(map[string]string{
+			AnnotationPaths: "/billing,/invoices",
+		}), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).To(HaveLen(2))
+		Expect(routes[0].Match.GetPrefix()).To(Equal("/billing"))
+		Expect(routes[1].Match.GetPrefix()).To(Equal("/invoices"))
+	})
+
+	It("should return an error when path is invalid", func() {
+		_, err := newRoutes(newTestService(map[string]string{
+			AnnotationPaths: "billing",
+		}), nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should rewrite each path prefix", func() {
+		routes, err := newRoutes(newTestService(map[string]string{
+			AnnotationPaths:         "/billing,/invoices",
+			AnnotationPrefixRewrite: "/,/v2/invoices",
+		}), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).To(HaveLen(2))
+		Expect(routes[0].GetRoute().PrefixRewrite).To(Equal("/"))
+		Expect(routes[1].GetRoute().PrefixRewrite).To(Equal("/v2/invoices"))
+	})
+
+	It("should return an error when prefix rewrites don't match paths", func() {
+		_, err := newRoutes(newTestService(map[string]string{
+			AnnotationPaths:         "/billing,/invoices",
+			AnnotationPrefixRewrite: "/",
+		}), nil)
+		Expect(merry.Is(err, ErrInvalidAnnotation)).To(BeTrue())
+	})
+})
+
+var _ = Describe("newRoute", func() {
+	Describe("traffic split", func() {
+		It("should route to the service by default", func() {
+			action := mustNewRouteAction(map[string]string{})
+			Expect(action.ClusterSpecifier).To(Equal(&route.RouteAction_Cluster{
+				Cluster: "foo",
+			}))
+		})
+
+		It("should split traffic", func() {
+			r, err := newRoute(newTestService(map[string]string{
+				AnnotationTrafficSplit: "foo-canary=10, foo-v2=5",
+			}), map[string]bool{"foo": true, "foo-canary": true, "foo-v2": true}, "/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Action.(*route.Route_Route).Route.ClusterSpecifier).To(Equal(&route.RouteAction_WeightedClusters{
+				WeightedClusters: &route.WeightedCluster{
+					Clusters: []*route.WeightedCluster_ClusterWeight{
+						{Name: "foo", Weight: &types.UInt32Value{Value: 85}},
+						{Name: "foo-canary", Weight: &types.UInt32Value{Value: 10}},
+						{Name: "foo-v2", Weight: &types.UInt32Value{Value: 5}},
+					},
+				},
+			}))
+		})
+
+		It("should return an error when the cluster does not exist", func() {
+			_, err := newRoute(newTestService(map[string]string{
+				AnnotationTrafficSplit: "foo-canary=10",
+			}), map[string]bool{"foo": true}, "/")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("match", func() {
+		It("should match all paths by default", func() {
+			r, err := newRoute(newTestService(map[string]string{}), nil, "/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Match).To(Equal(route.RouteMatch{
+				PathSpecifier: &route.RouteMatch_Prefix{
+					Prefix: "/",
+				},
+			}))
+		})
+
+		It("should match headers", func() {
+			r, err := newRoute(newTestService(map[string]string{
+				AnnotationMatchHeaders: "x-version=beta\nx-user~=^admin-.*$\nx-debug",
+			}), nil, "/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Match.Headers).To(Equal([]*route.HeaderMatcher{
+				{
+					Name:                 "x-version",
+					HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "beta"},
+				},
+				{
+					Name:                 "x-user",
+					HeaderMatchSpecifier: &route.HeaderMatcher_RegexMatch{RegexMatch: "^admin-.*$"},
+				},
+				{
+					Name:                 "x-debug",
+					HeaderMatchSpecifier: &route.HeaderMatcher_PresentMatch{PresentMatch: true},
+				},
+			}))
+		})
+
+		It("should match query parameters", func() {
+			r, err := newRoute(newTestService(map[string]string{
+				AnnotationMatchQuery: "version=2\nid~=[0-9]+\ndebug",
+			}), nil, "/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Match.QueryParameters).To(Equal([]*route.QueryParameterMatcher{
+				{Name: "version", Value: "2"},
+				{Name: "id", Value: "[0-9]+", Regex: &types.BoolValue{Value: true}},
+				{Name: "debug"},
+			}))
+		})
+
+		It("should not split regular expressions containing commas", func() {
+			r, err := newRoute(newTestService(map[string]string{
+				AnnotationMatchHeaders: "x-id~=^[0-9]{1,3}$",
+				AnnotationMatchQuery:   "id~=^[0-9]{1,3}$",
+			}), nil, "/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Match.Headers).To(Equal([]*route.HeaderMatcher{
+				{
+					Name:                 "x-id",
+					HeaderMatchSpecifier: &route.HeaderMatcher_RegexMatch{RegexMatch: "^[0-9]{1,3}$"},
+				},
+			}))
+			Expect(r.Match.QueryParameters).To(Equal([]*route.QueryParameterMatcher{
+				{Name: "id", Value: "^[0-9]{1,3}$", Regex: &types.BoolValue{Value: true}},
+			}))
+		})
+	})
+
+	Describe("request mirror policy", func() {
+		It("should not mirror requests by default", func() {
+			action := mustNewRouteAction(map[string]string{})
+			Expect(action.RequestMirrorPolicy).To(BeNil())
+		})
+
+		It("should mirror all requests", func() {
+			r, err := newRoute(newTestService(map[string]string{
+				AnnotationMirror: "bar",
+			}), map[string]bool{"foo": true, "bar": true}, "/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Action.(*route.Route_Route).Route.RequestMirrorPolicy).To(Equal(&route.RouteAction_RequestMirrorPolicy{
+				Cluster: "bar",
+			}))
+		})
+
+		It("should mirror a percentage of requests", func() {
+			r, err := newRoute(newTestService(map[string]string{
+				AnnotationMirror:        "bar",
+				AnnotationMirrorPercent: "25",
+			}), map[string]bool{"foo": true, "bar": true}, "/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Action.(*route.Route_Route).Route.RequestMirrorPolicy).To(Equal(&route.RouteAction_RequestMirrorPolicy{
+				Cluster: "bar",
+				RuntimeFraction: &core.RuntimeFractionalPercent{
+					DefaultValue: &envoy_type.FractionalPercent{
+						Numerator:   25,
+						Denominator: envoy_type.FractionalPercent_HUNDRED,
+					},
+				},
+			}))
+		})
+
+		It("should return an error when the cluster does not exist", func() {
+			_, err := newRoute(newTestService(map[string]string{
+				AnnotationMirror: "bar",
+			}), map[string]bool{"foo": true}, "/")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("rewrites", func() {
+		It("should not rewrite by default", func() {
+			action := mustNewRouteAction(map[string]string{})
+			Expect(action.PrefixRewrite).To(BeEmpty())
+			Expect(action.HostRewriteSpecifier).To(BeNil())
+		})
+
+		It("should rewrite prefix and host", func() {
+			action := mustNewRouteAction(map[string]string{
+				AnnotationPrefixRewrite: "/",
+				AnnotationHostRewrite:   "billing.internal",
+			})
+			Expect(action.PrefixRewrite).To(Equal("/"))
+			Expect(action.HostRewriteSpecifier).To(Equal(&route.RouteAction_HostRewrite{
+				HostRewrite: "billing.internal",
+			}))
+		})
+
+		It("should rewrite host automatically", func() {
+			action := mustNewRouteAction(map[string]string{
+				AnnotationAutoHostRewrite: "true",
+			})
+			Expect(action.HostRewriteSpecifier).To(Equal(&route.RouteAction_AutoHostRewrite{
+				AutoHostRewrite: &types.BoolValue{Value: true},
+			}))
+		})
+	})
+
+	Describe("timeouts", func() {
+		It("should not set timeouts by default", func() {
+			action := mustNewRouteAction(map[string]string{})
+			Expect(action.Timeout).To(BeNil())
+			Expect(action.IdleTimeout).To(BeNil())
+		})
+
+		It("should set timeout", func() {
+			action := mustNewRouteAction(map[string]string{
+				AnnotationTimeout: "30s",
+			})
+			Expect(action.Timeout).To(Equal(durationPtr(30 * time.Second)))
+		})
+
+		It("should set idle timeout", func() {
+			action := mustNewRouteAction(map[string]string{
+				AnnotationIdleTimeout: "5m",
+			})
+			Expect(action.IdleTimeout).To(Equal(durationPtr(5 * time.Minute)))
+		})
+	})
+
+	Describe("retry policy", func() {
+		It("should not set retry policy by default", func() {
+			action := mustNewRouteAction(map[string]string{})
+			Expect(action.RetryPolicy).To(BeNil())
+		})
+
+		It("should set retry policy", func() {
+			action := mustNewRouteAction(map[string]string{
+				AnnotationRetries:       "3",
+				AnnotationPerTryTimeout: "2s",
+				AnnotationRetryOn:       "5xx, connect-failure",
+			})
+			Expect(action.RetryPolicy).To(Equal(&route.RetryPolicy{
+				RetryOn:       "5xx,connect-failure",
+				NumRetries:    &types.UInt32Value{Value: 3},
+				PerTryTimeout: durationPtr(2 * time.Second),
+			}))
+		})
+
+		It("should enable retriable-status-codes when status codes are given", func() {
+			action := mustNewRouteAction(map[string]string{
+				AnnotationRetriableStatusCodes: "503,504",
+			})
+			Expect(action.RetryPolicy).To(Equal(&route.RetryPolicy{
+				RetryOn:              "retriable-status-codes",
+				RetriableStatusCodes: []uint32{503, 504},
+			}))
+		})
+	})
+
+	Describe("hash policy", func() {
+		It("should not set hash policy by default", func() {
+			action := mustNewRouteAction(map[string]string{})
+			Expect(action.HashPolicy).To(BeEmpty())
+		})
+
+		It("should set hash policies", func() {
+			action := mustNewRouteAction(map[string]string{
+				AnnotationHashPolicy:    "header:x-user-id,cookie:session,source_ip",
+				AnnotationHashCookieTTL: "1h",
+			})
+			Expect(action.HashPolicy).To(Equal([]*route.RouteAction_HashPolicy{
+				{
+					PolicySpecifier: &route.RouteAction_HashPolicy_Header_{
+						Header: &route.RouteAction_HashPolicy_Header{
+							HeaderName: "x-user-id",
+						},
+					},
+				},
+				{
+					PolicySpecifier: &route.RouteAction_HashPolicy_Cookie_{
+						Cookie: &route.RouteAction_HashPolicy_Cookie{
+							Name: "session",
+							Ttl:  durationPtr(time.Hour),
+						},
+					},
+				},
+				newSourceIPHashPolicy(),
+			}))
+		})
+
+		It("should hash by source IP when session affinity is ClientIP", func() {
+			svc := newTestService(map[string]string{})
+			svc.Spec.SessionAffinity = corev1.ServiceAffinityClientIP
+			r, err := newRoute(svc, nil, "/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Action.(*route.Route_Route).Route.HashPolicy).To(Equal([]*route.RouteAction_HashPolicy{
+				newSourceIPHashPolicy(),
+			}))
+		})
+	})
+
+	DescribeTable("invalid annotations", func(annotations map[string]string) {
+		_, err := newRoute(newTestService(annotations), nil, "/")
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("timeout", map[string]string{AnnotationTimeout: "foo"}),
+		Entry("negative timeout", map[string]string{AnnotationTimeout: "-1s"}),
+		Entry("idle timeout", map[string]string{AnnotationIdleTimeout: "foo"}),
+		Entry("retries", map[string]string{AnnotationRetries: "-1", AnnotationRetryOn: "5xx"}),
+		Entry("retries without retry_on", map[string]string{AnnotationRetries: "3"}),
+		Entry("retry_on", map[string]string{AnnotationRetryOn: "5xx,foo"}),
+		Entry("status code", map[string]string{AnnotationRetriableStatusCodes: "abc"}),
+		Entry("status code out of range", map[string]string{AnnotationRetriableStatusCodes: "600"}),
+		Entry("hash policy", map[string]string{AnnotationHashPolicy: "query:foo"}),
+		Entry("hash policy without name", map[string]string{AnnotationHashPolicy: "header"}),
+		Entry("hash cookie ttl", map[string]string{AnnotationHashCookieTTL: "foo"}),
+		Entry("traffic split without weight", map[string]string{AnnotationTrafficSplit: "bar"}),
+		Entry("traffic split to itself", map[string]string{AnnotationTrafficSplit: "foo=10"}),
+		Entry("traffic split over 100", map[string]string{AnnotationTrafficSplit: "bar=60,baz=50"}),
+		Entry("header matcher without name", map[string]string{AnnotationMatchHeaders: "=foo"}),
+		Entry("header matcher with invalid regex", map[string]string{AnnotationMatchHeaders: "x-foo~=(foo"}),
+		Entry("query matcher with invalid regex", map[string]string{AnnotationMatchQuery: "foo~=[a-"}),
+		Entry("auto host rewrite", map[string]string{AnnotationAutoHostRewrite: "foo"}),
+		Entry("host rewrite with auto host rewrite", map[string]string{AnnotationHostRewrite: "foo", AnnotationAutoHostRewrite: "true"}),
+	)
+})
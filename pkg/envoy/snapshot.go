@@ -1,39 +1,187 @@
 package envoy
 
 import (
+	"sort"
 	"time"
 
 	"github.com/ansel1/merry"
 	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
-	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
-	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
 	envoycache "github.com/envoyproxy/go-control-plane/pkg/cache"
-	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/rs/zerolog"
+	"github.com/tommy351/kubenvoy/pkg/config"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
 const (
-	AnnotationDomains        = "kds.kubenvoy.dev/domains"
-	AnnotationPort           = "kds.kubenvoy.dev/port"
-	AnnotationConnectTimeout = "kds.kubenvoy.dev/connect_timeout"
-	AnnotationLbPolicy       = "kds.kubenvoy.dev/lb_policy"
+	AnnotationDomains         = "kds.kubenvoy.dev/domains"
+	AnnotationPort            = "kds.kubenvoy.dev/port"
+	AnnotationConnectTimeout  = "kds.kubenvoy.dev/connect_timeout"
+	AnnotationLbPolicy        = "kds.kubenvoy.dev/lb_policy"
+	AnnotationDNSLookupFamily = "kds.kubenvoy.dev/dns_lookup_family"
+
+	AnnotationTimeout              = "kds.kubenvoy.dev/timeout"
+	AnnotationIdleTimeout          = "kds.kubenvoy.dev/idle_timeout"
+	AnnotationRetries              = "kds.kubenvoy.dev/retries"
+	AnnotationPerTryTimeout        = "kds.kubenvoy.dev/per_try_timeout"
+	AnnotationRetryOn              = "kds.kubenvoy.dev/retry_on"
+	AnnotationRetriableStatusCodes = "kds.kubenvoy.dev/retriable_status_codes"
+
+	AnnotationMaxConnections                 = "kds.kubenvoy.dev/max_connections"
+	AnnotationMaxPendingRequests             = "kds.kubenvoy.dev/max_pending_requests"
+	AnnotationMaxRequests                    = "kds.kubenvoy.dev/max_requests"
+	AnnotationMaxRetries                     = "kds.kubenvoy.dev/max_retries"
+	AnnotationHighPriorityMaxConnections     = "kds.kubenvoy.dev/high_priority_max_connections"
+	AnnotationHighPriorityMaxPendingRequests = "kds.kubenvoy.dev/high_priority_max_pending_requests"
+	AnnotationHighPriorityMaxRequests        = "kds.kubenvoy.dev/high_priority_max_requests"
+	AnnotationHighPriorityMaxRetries         = "kds.kubenvoy.dev/high_priority_max_retries"
+
+	AnnotationConsecutive5xx            = "kds.kubenvoy.dev/consecutive_5xx"
+	AnnotationConsecutiveGatewayFailure = "kds.kubenvoy.dev/consecutive_gateway_failure"
+	AnnotationOutlierInterval           = "kds.kubenvoy.dev/outlier_interval"
+	AnnotationBaseEjectionTime          = "kds.kubenvoy.dev/base_ejection_time"
+	AnnotationMaxEjectionPercent        = "kds.kubenvoy.dev/max_ejection_percent"
+
+	AnnotationHealthCheck                 = "kds.kubenvoy.dev/health_check"
+	AnnotationHealthCheckPath             = "kds.kubenvoy.dev/health_check_path"
+	AnnotationHealthCheckExpectedStatuses = "kds.kubenvoy.dev/health_check_expected_statuses"
+	AnnotationHealthCheckInterval         = "kds.kubenvoy.dev/health_check_interval"
+	AnnotationHealthCheckTimeout          = "kds.kubenvoy.dev/health_check_timeout"
+	AnnotationHealthyThreshold            = "kds.kubenvoy.dev/healthy_threshold"
+	AnnotationUnhealthyThreshold          = "kds.kubenvoy.dev/unhealthy_threshold"
+
+	AnnotationHashPolicy      = "kds.kubenvoy.dev/hash_policy"
+	AnnotationHashCookieTTL   = "kds.kubenvoy.dev/hash_cookie_ttl"
+	AnnotationMinimumRingSize = "kds.kubenvoy.dev/minimum_ring_size"
+
+	AnnotationTrafficSplit = "kds.kubenvoy.dev/traffic_split"
+
+	AnnotationMatchHeaders = "kds.kubenvoy.dev/match_headers"
+	AnnotationMatchQuery   = "kds.kubenvoy.dev/match_query"
+
+	AnnotationMirror        = "kds.kubenvoy.dev/mirror"
+	AnnotationMirrorPercent = "kds.kubenvoy.dev/mirror_percent"
+
+	AnnotationFaultDelay        = "kds.kubenvoy.dev/fault_delay"
+	AnnotationFaultDelayPercent = "kds.kubenvoy.dev/fault_delay_percent"
+	AnnotationFaultAbortStatus  = "kds.kubenvoy.dev/fault_abort_status"
+	AnnotationFaultAbortPercent = "kds.kubenvoy.dev/fault_abort_percent"
+
+	AnnotationRequestHeadersToAdd     = "kds.kubenvoy.dev/request_headers_to_add"
+	AnnotationRequestHeadersToRemove  = "kds.kubenvoy.dev/request_headers_to_remove"
+	AnnotationResponseHeadersToAdd    = "kds.kubenvoy.dev/response_headers_to_add"
+	AnnotationResponseHeadersToRemove = "kds.kubenvoy.dev/response_headers_to_remove"
+
+	AnnotationPaths           = "kds.kubenvoy.dev/paths"
+	AnnotationPrefixRewrite   = "kds.kubenvoy.dev/prefix_rewrite"
+	AnnotationHostRewrite     = "kds.kubenvoy.dev/host_rewrite"
+	AnnotationAutoHostRewrite = "kds.kubenvoy.dev/auto_host_rewrite"
+
+	AnnotationCorsAllowOrigin      = "kds.kubenvoy.dev/cors_allow_origin"
+	AnnotationCorsAllowOriginRegex = "kds.kubenvoy.dev/cors_allow_origin_regex"
+	AnnotationCorsAllowMethods     = "kds.kubenvoy.dev/cors_allow_methods"
+	AnnotationCorsAllowHeaders     = "kds.kubenvoy.dev/cors_allow_headers"
+	AnnotationCorsExposeHeaders    = "kds.kubenvoy.dev/cors_expose_headers"
+	AnnotationCorsMaxAge           = "kds.kubenvoy.dev/cors_max_age"
+	AnnotationCorsAllowCredentials = "kds.kubenvoy.dev/cors_allow_credentials"
+
+	AnnotationRedirectHost         = "kds.kubenvoy.dev/redirect_host"
+	AnnotationRedirectPath         = "kds.kubenvoy.dev/redirect_path"
+	AnnotationRedirectCode         = "kds.kubenvoy.dev/redirect_code"
+	AnnotationHTTPSRedirect        = "kds.kubenvoy.dev/https_redirect"
+	AnnotationDirectResponseStatus = "kds.kubenvoy.dev/direct_response_status"
+	AnnotationDirectResponseBody   = "kds.kubenvoy.dev/direct_response_body"
+
+	AnnotationGzip = "kds.kubenvoy.dev/gzip"
+
+	AnnotationUpgradeTypes = "kds.kubenvoy.dev/upgrade_types"
+
+	AnnotationTCPProxyPorts  = "kds.kubenvoy.dev/tcp_proxy_ports"
+	AnnotationTCPIdleTimeout = "kds.kubenvoy.dev/tcp_idle_timeout"
+
+	AnnotationTLSPassthrough = "kds.kubenvoy.dev/tls_passthrough"
+
+	AnnotationZoneAwareRoutingPercent = "kds.kubenvoy.dev/zone_aware_routing_percent"
+	AnnotationZoneAwareMinClusterSize = "kds.kubenvoy.dev/zone_aware_min_cluster_size"
+	AnnotationZoneFailover            = "kds.kubenvoy.dev/zone_failover"
+
+	AnnotationWeight = "kds.kubenvoy.dev/weight"
+
+	AnnotationSubsetSelectors = "kds.kubenvoy.dev/subset_selectors"
+	AnnotationSubsetDefault   = "kds.kubenvoy.dev/subset_default"
+	AnnotationSubsetRoutes    = "kds.kubenvoy.dev/subset_routes"
+
+	AnnotationDNSType     = "kds.kubenvoy.dev/dns_type"
+	AnnotationUpstreamTLS = "kds.kubenvoy.dev/upstream_tls"
+	AnnotationUpstreamSNI = "kds.kubenvoy.dev/upstream_sni"
 
 	DefaultConnectTimeout = time.Second
+
+	DefaultHealthCheckPath     = "/"
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = time.Second
+	DefaultHealthyThreshold    = 1
+	DefaultUnhealthyThreshold  = 3
 )
 
 var (
 	ErrEmptyEndpointSubset = merry.New("subset of endpoint is empty")
 	ErrNoPort              = merry.New("cannot find a port")
+	ErrInvalidRetryOn      = merry.New("invalid retry_on condition")
+	ErrInvalidStatusCode   = merry.New("invalid HTTP status code")
+	ErrNoRetryOn           = merry.New("retry_on is required when retries are configured")
+	ErrInvalidHealthCheck  = merry.New("invalid health check type")
+	ErrInvalidHashPolicy   = merry.New("invalid hash policy")
+	ErrInvalidTrafficSplit = merry.New("invalid traffic split")
+	ErrClusterNotFound     = merry.New("cannot find the cluster")
+	ErrInvalidMatcher      = merry.New("invalid matcher")
+	ErrConflictAnnotations = merry.New("annotations cannot be used together")
+	ErrInvalidHeader       = merry.New("invalid header")
+
+	ErrInvalidCompressionLevel = merry.New("invalid compression level")
+	ErrDuplicateListenerPort   = merry.New("listener port is already in use")
+	ErrDuplicateServerName     = merry.New("server name is already in use")
+	ErrInvalidDNSLookupFamily  = merry.New("invalid DNS lookup family")
 )
 
 type SnapshotOptions struct {
 	Version   string
 	Endpoints cache.Store
 	Services  cache.Store
+	Nodes     cache.Store
+	Pods      cache.Store
+	Config    *config.EnvoyConfig
+
+	// EndpointSlices contains unstructured EndpointSlices. Endpoints are
+	// aggregated from it instead of Endpoints when it's set.
+	EndpointSlices cache.Store
+
+	// Locality is the locality of Envoys the snapshot is built for.
+	Locality *core.Locality
+
+	// Drains contains removed and not ready addresses in the grace period,
+	// which are returned by DrainTracker.Update. Addresses are removed
+	// immediately when it's nil.
+	Drains *Drains
+
+	// Logger logs problems which don't fail the snapshot, such as invalid
+	// annotations of pods. Nothing is logged when it's nil.
+	Logger *zerolog.Logger
+
+	// Time is when the snapshot is built. Weights of pods in slow start are
+	// computed at this time. The current time is used when it's zero.
+	Time time.Time
+}
+
+func (o *SnapshotOptions) getTime() time.Time {
+	if o.Time.IsZero() {
+		return time.Now()
+	}
+
+	return o.Time
 }
 
 func NewSnapshot(options *SnapshotOptions) (*envoycache.Snapshot, error) {
@@ -42,19 +190,63 @@ func NewSnapshot(options *SnapshotOptions) (*envoycache.Snapshot, error) {
 		vhosts                                 []route.VirtualHost
 	)
 
+	conf := options.Config
+
+	if conf == nil {
+		conf = new(config.EnvoyConfig)
+	}
+
+	logger := options.Logger
+
+	if logger == nil {
+		nop := zerolog.Nop()
+		logger = &nop
+	}
+
+	now := options.getTime()
 	routeMap := map[string][]route.Route{}
-	svcMap := map[string]*corev1.Service{}
+	clusterSet := map[string]bool{}
+	gzipSet := map[string]bool{}
+	passthroughSet := map[string]bool{}
+	svcMap := getServiceMap(options.Services)
+	exposed := getExposedServices(svcMap)
+	localities := getNodeLocalities(options.Nodes)
+	tcpProxies, err := getTCPProxies(svcMap)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
 
-	for _, obj := range options.Services.List() {
-		if svc, ok := obj.(*corev1.Service); ok {
-			svcMap[svc.Name] = svc
+	backends, err := getBackends(exposed, conf)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	for _, svc := range exposed {
+		if gzipSet[svc.Name], err = isGzipEnabled(svc, &conf.Gzip); err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		if passthroughSet[svc.Name], err = isTLSPassthrough(svc); err != nil {
+			return nil, merry.Wrap(err)
 		}
 	}
 
-	for _, obj := range options.Endpoints.List() {
-		ep, ok := obj.(*corev1.Endpoints)
+	useGzip := false
 
-		if !ok {
+	for _, enabled := range gzipSet {
+		useGzip = useGzip || enabled
+	}
+
+	epList, err := listEndpoints(options)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	for _, ep := range epList {
+		if !backends[ep.Name] && len(tcpProxies[ep.Name]) == 0 {
 			continue
 		}
 
@@ -64,30 +256,171 @@ func NewSnapshot(options *SnapshotOptions) (*envoycache.Snapshot, error) {
 			continue
 		}
 
-		annotations := svc.Annotations
-		domain := annotations[AnnotationDomains]
+		for _, port := range tcpProxies[ep.Name] {
+			name := getTCPProxyClusterName(svc, port)
+
+			cla, err := newClusterLoadAssignment(&loadAssignmentOptions{
+				Name:       name,
+				Service:    svc,
+				Endpoints:  ep,
+				Port:       port.ServicePort,
+				Localities: localities,
+				Locality:   options.Locality,
+				Drains:     options.Drains,
+				Pods:       options.Pods,
+				Weights:    &conf.Weights,
+				Logger:     logger,
+				Time:       now,
+			})
+
+			if merry.Is(err, ErrEmptyEndpointSubset) {
+				logger.Warn().Err(err).Str("cluster", name).Msg("Skipped the TCP proxy of the service")
+				continue
+			}
+
+			if err != nil {
+				return nil, merry.Wrap(err)
+			}
 
-		if domain == "" {
+			endpoints = append(endpoints, cla)
+
+			if cluster, err := newCluster(name, svc, conf); err == nil {
+				clusters = append(clusters, cluster)
+			} else {
+				return nil, merry.Wrap(err)
+			}
+
+			if ln, err := newTCPListener(svc, port, conf); err == nil {
+				listeners = append(listeners, ln)
+			} else {
+				return nil, merry.Wrap(err)
+			}
+		}
+
+		if !backends[ep.Name] {
 			continue
 		}
 
-		if cla, err := newClusterLoadAssignment(svc, ep); err == nil {
-			endpoints = append(endpoints, cla)
-		} else {
+		cla, err := newClusterLoadAssignment(&loadAssignmentOptions{
+			Name:       ep.Name,
+			Service:    svc,
+			Endpoints:  ep,
+			Port:       svc.Annotations[AnnotationPort],
+			Localities: localities,
+			Locality:   options.Locality,
+			Drains:     options.Drains,
+			Pods:       options.Pods,
+			Weights:    &conf.Weights,
+			Subsets:    &conf.Subsets,
+			Logger:     logger,
+			Time:       now,
+		})
+
+		// Services without endpoints don't have clusters, so routes referring
+		// to them are skipped below instead of failing the whole snapshot.
+		if merry.Is(err, ErrEmptyEndpointSubset) {
+			logger.Warn().Err(err).Str("service", svc.Name).Msg("Skipped the cluster of the service")
+			continue
+		}
+
+		if err != nil {
 			return nil, merry.Wrap(err)
 		}
 
-		if cluster, err := newCluster(svc, ep); err == nil {
+		endpoints = append(endpoints, cla)
+
+		cluster, err := newCluster(ep.Name, svc, conf)
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		// Only clusters of services have subsets. TCP proxies and
+		// ExternalName services don't have labels of pods.
+		if cluster.LbSubsetConfig, err = newLbSubsetConfig(svc, &conf.Subsets); err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		clusters = append(clusters, cluster)
+		clusterSet[ep.Name] = true
+	}
+
+	// ExternalName services don't have endpoints, so their clusters resolve
+	// the external name with DNS.
+	for name := range backends {
+		svc, ok := svcMap[name]
+
+		if !ok || clusterSet[name] || !isExternalService(svc) {
+			continue
+		}
+
+		if cluster, err := newExternalCluster(svc, conf); err == nil {
 			clusters = append(clusters, cluster)
 		} else {
 			return nil, merry.Wrap(err)
 		}
 
-		routeMap[domain] = append(routeMap[domain], *newRoute(ep))
+		clusterSet[name] = true
+	}
+
+	var passthrough []*corev1.Service
+
+	for _, svc := range exposed {
+		if hasBackend(svc) && !clusterSet[svc.Name] {
+			continue
+		}
+
+		// TLS passthrough services are proxied by SNI instead of routes.
+		if passthroughSet[svc.Name] {
+			if clusterSet[svc.Name] {
+				passthrough = append(passthrough, svc)
+			}
+
+			continue
+		}
+
+		domain := svc.Annotations[AnnotationDomains]
+
+		// Mirrors to missing clusters are dropped, so requests are still sent
+		// to the service. Services in the store must not be modified.
+		if mirror := svc.Annotations[AnnotationMirror]; mirror != "" && !clusterSet[mirror] {
+			logger.Warn().
+				Str("service", svc.Name).
+				Str("cluster", mirror).
+				Msg("Dropped the mirror of the service because the cluster is not found")
+			svc = svc.DeepCopy()
+			delete(svc.Annotations, AnnotationMirror)
+		}
+
+		r, err := newRoutes(svc, clusterSet)
+
+		// Routes referring to missing clusters are skipped, so a broken
+		// service doesn't take down routes of other services.
+		if merry.Is(err, ErrClusterNotFound) {
+			logger.Warn().Err(err).Str("service", svc.Name).Msg("Skipped routes of the service")
+			continue
+		}
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		if r, err = addSubsetRoutes(svc, &conf.Subsets, r); err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		if useGzip && isGzipDisabled(svc) {
+			disableGzip(r)
+		}
+
+		setRouteUpgrades(svc, &conf.Upgrade, r)
+
+		routeMap[domain] = append(routeMap[domain], r...)
 	}
 
 	if len(routeMap) > 0 {
 		for domain, routes := range routeMap {
+			sortRoutes(routes)
 			vhosts = append(vhosts, route.VirtualHost{
 				Name:    domain,
 				Domains: []string{domain},
@@ -100,47 +433,32 @@ func NewSnapshot(options *SnapshotOptions) (*envoycache.Snapshot, error) {
 			VirtualHosts: vhosts,
 		}
 
+		if err := setRouteConfigurationHeaders(&conf.Headers, routeConf); err != nil {
+			return nil, merry.Wrap(err)
+		}
+
 		routes = append(routes, routeConf)
-		hcmConfig, err := util.MessageToStruct(&hcm.HttpConnectionManager{
-			CodecType:  hcm.AUTO,
-			StatPrefix: "http",
-			RouteSpecifier: &hcm.HttpConnectionManager_Rds{
-				Rds: &hcm.Rds{
-					ConfigSource: core.ConfigSource{
-						ConfigSourceSpecifier: &core.ConfigSource_Ads{
-							Ads: &core.AggregatedConfigSource{},
-						},
-					},
-					RouteConfigName: routeConf.Name,
-				},
-			},
-			HttpFilters: []*hcm.HttpFilter{
-				{
-					Name: util.Router,
-				},
-			},
+		ln, err := newHTTPListener(&httpListenerOptions{
+			RouteConfig: routeConf,
+			Gzip:        useGzip,
+			Config:      conf,
 		})
 
 		if err != nil {
 			return nil, merry.Wrap(err)
 		}
 
-		listeners = append(listeners, &api.Listener{
-			Name:    "kds",
-			Address: *newSocketAddress("0.0.0.0", 10000),
-			FilterChains: []listener.FilterChain{
-				{
-					Filters: []listener.Filter{
-						{
-							Name: util.HTTPConnectionManager,
-							ConfigType: &listener.Filter_Config{
-								Config: hcmConfig,
-							},
-						},
-					},
-				},
-			},
-		})
+		listeners = append(listeners, ln)
+	}
+
+	if len(passthrough) > 0 {
+		ln, err := newTLSPassthroughListener(passthrough, conf)
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		listeners = append(listeners, ln)
 	}
 
 	snapshot := envoycache.NewSnapshot(options.Version, endpoints, clusters, routes, listeners)
@@ -152,6 +470,87 @@ func NewSnapshot(options *SnapshotOptions) (*envoycache.Snapshot, error) {
 	return &snapshot, nil
 }
 
+func getServiceMap(services cache.Store) map[string]*corev1.Service {
+	result := map[string]*corev1.Service{}
+
+	for _, obj := range services.List() {
+		if svc, ok := obj.(*corev1.Service); ok {
+			result[svc.Name] = svc
+		}
+	}
+
+	return result
+}
+
+// getBackends returns names of services which need clusters, including
+// services referenced by the exposed services.
+func getBackends(exposed []*corev1.Service, conf *config.EnvoyConfig) (map[string]bool, error) {
+	result := map[string]bool{}
+
+	for _, svc := range exposed {
+		refs, err := getServiceReferences(svc)
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		if hasBackend(svc) {
+			result[svc.Name] = true
+		}
+
+		for _, name := range refs {
+			result[name] = true
+		}
+	}
+
+	// The local cluster is required by zone-aware routing, even if it's not
+	// exposed.
+	if name := conf.Locality.LocalCluster; name != "" {
+		result[name] = true
+	}
+
+	return result, nil
+}
+
+// getExposedServices returns services with the domains annotation, sorted by
+// name.
+func getExposedServices(svcMap map[string]*corev1.Service) []*corev1.Service {
+	var result []*corev1.Service
+
+	for _, svc := range svcMap {
+		if svc.Annotations[AnnotationDomains] != "" {
+			result = append(result, svc)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+// getServiceReferences returns names of other services the routes of a
+// service are sent to.
+func getServiceReferences(svc *corev1.Service) ([]string, error) {
+	var result []string
+	weights, err := getTrafficSplit(svc)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	for _, w := range weights {
+		result = append(result, w.Name)
+	}
+
+	if mirror := svc.Annotations[AnnotationMirror]; mirror != "" {
+		result = append(result, mirror)
+	}
+
+	return result, nil
+}
+
 func getPortByName(ports []corev1.EndpointPort, name string) *corev1.EndpointPort {
 	if len(ports) == 0 {
 		return nil
@@ -168,85 +567,134 @@ func getPortByName(ports []corev1.EndpointPort, name string) *corev1.EndpointPor
 	return &ports[0]
 }
 
-func newClusterLoadAssignment(svc *corev1.Service, ep *corev1.Endpoints) (*api.ClusterLoadAssignment, error) {
-	if len(ep.Subsets) == 0 {
+type loadAssignmentOptions struct {
+	Name       string
+	Service    *corev1.Service
+	Endpoints  *corev1.Endpoints
+	Port       string
+	Localities map[string]*core.Locality
+	Locality   *core.Locality
+	Drains     *Drains
+	Pods       cache.Store
+	Weights    *config.WeightsConfig
+	Subsets    *config.SubsetsConfig
+	Logger     *zerolog.Logger
+	Time       time.Time
+}
+
+// endpointAddress is an address of endpoints resolved with the port.
+type endpointAddress struct {
+	Address      *corev1.EndpointAddress
+	Port         uint32
+	HealthStatus core.HealthStatus
+}
+
+// getEndpointAddresses returns ready and not ready addresses of endpoints
+// resolved with the port.
+func getEndpointAddresses(svc *corev1.Service, ep *corev1.Endpoints, portName string) (ready, notReady []endpointAddress, err error) {
+	// Addresses can be split into multiple subsets, for example when IPv4 and
+	// IPv6 addresses of a dual-stack service have different ports.
+	for i := range ep.Subsets {
+		subset := &ep.Subsets[i]
+		port := getPortByName(subset.Ports, portName)
+
+		if port == nil {
+			return nil, nil, ErrNoPort.Here().WithValue("service", svc.Name)
+		}
+
+		for j := range subset.Addresses {
+			ready = append(ready, endpointAddress{
+				Address: &subset.Addresses[j],
+				Port:    uint32(port.Port),
+			})
+		}
+
+		for j := range subset.NotReadyAddresses {
+			notReady = append(notReady, endpointAddress{
+				Address: &subset.NotReadyAddresses[j],
+				Port:    uint32(port.Port),
+			})
+		}
+	}
+
+	return ready, notReady, nil
+}
+
+// newClusterLoadAssignment groups addresses of endpoints by localities of
+// their nodes.
+func newClusterLoadAssignment(options *loadAssignmentOptions) (*api.ClusterLoadAssignment, error) {
+	svc, ep := options.Service, options.Endpoints
+
+	// Endpoints without subsets still have addresses in the grace period, so
+	// addresses of services scaled to zero are drained as well.
+	if len(ep.Subsets) == 0 && options.Drains == nil {
 		return nil, ErrEmptyEndpointSubset.Here().WithValue("service", svc.Name)
 	}
 
-	subset := ep.Subsets[0]
-	port := getPortByName(subset.Ports, svc.Annotations[AnnotationPort])
+	addresses, _, err := getEndpointAddresses(svc, ep, options.Port)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
 
-	if port == nil {
-		return nil, ErrNoPort.Here().WithValue("service", svc.Name)
+	// Addresses of clusters known by the drain tracker are taken from it, so
+	// snapshots of all node groups have the same addresses.
+	if drained, ok := options.Drains.get(options.Name); ok {
+		addresses = drained
 	}
 
-	lbEndpoints := make([]endpoint.LbEndpoint, len(subset.Addresses))
+	var endpoints []endpoint.LocalityLbEndpoints
+	indexes := map[string]int{}
+	subsets := options.Subsets != nil && hasSubsets(svc, options.Subsets)
+
+	for _, addr := range addresses {
+		locality := getAddressLocality(addr.Address, options.Localities)
+		key := getLocalityKey(locality)
+		index, ok := indexes[key]
+
+		if !ok {
+			index = len(endpoints)
+			indexes[key] = index
+			endpoints = append(endpoints, endpoint.LocalityLbEndpoints{Locality: locality})
+		}
 
-	for i, addr := range subset.Addresses {
-		lbEndpoints[i] = endpoint.LbEndpoint{
+		lbEndpoint := endpoint.LbEndpoint{
 			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
 				Endpoint: &endpoint.Endpoint{
-					Address: newSocketAddress(addr.IP, uint32(port.Port)),
+					Address: newSocketAddress(addr.Address.IP, addr.Port),
 				},
 			},
+			HealthStatus: addr.HealthStatus,
 		}
-	}
 
-	return &api.ClusterLoadAssignment{
-		ClusterName: ep.Name,
-		Endpoints: []endpoint.LocalityLbEndpoints{
-			{LbEndpoints: lbEndpoints},
-		},
-	}, nil
-}
-
-func newCluster(svc *corev1.Service, ep *corev1.Endpoints) (*api.Cluster, error) {
-	cluster := &api.Cluster{
-		Name:            ep.Name,
-		ConnectTimeout:  DefaultConnectTimeout,
-		DnsLookupFamily: api.Cluster_V4_ONLY,
-		Type:            api.Cluster_EDS,
-		EdsClusterConfig: &api.Cluster_EdsClusterConfig{
-			EdsConfig: &core.ConfigSource{
-				ConfigSourceSpecifier: &core.ConfigSource_Ads{
-					Ads: &core.AggregatedConfigSource{},
-				},
-			},
-		},
-	}
+		pod, err := getAddressPod(addr.Address, options.Pods)
 
-	if s, ok := svc.Annotations[AnnotationConnectTimeout]; ok {
-		if timeout, err := time.ParseDuration(s); err == nil {
-			cluster.ConnectTimeout = timeout
-		} else {
+		if err != nil {
 			return nil, merry.Wrap(err)
 		}
-	}
 
-	if s, ok := svc.Annotations[AnnotationLbPolicy]; ok {
-		if v, ok := api.Cluster_LbPolicy_value[s]; ok {
-			cluster.LbPolicy = api.Cluster_LbPolicy(v)
+		if pod != nil && options.Weights != nil && options.Weights.Enabled {
+			lbEndpoint.LoadBalancingWeight = getEndpointWeight(pod, options.Weights, options.Time, options.Logger)
 		}
-	}
 
-	return cluster, nil
-}
+		// Labels of pods are used by subset load balancing.
+		if pod != nil && subsets {
+			lbEndpoint.Metadata = newLbMetadata(pod.Labels)
+		}
 
-func newRoute(ep *corev1.Endpoints) *route.Route {
-	return &route.Route{
-		Match: route.RouteMatch{
-			PathSpecifier: &route.RouteMatch_Prefix{
-				Prefix: "/",
-			},
-		},
-		Action: &route.Route_Route{
-			Route: &route.RouteAction{
-				ClusterSpecifier: &route.RouteAction_Cluster{
-					Cluster: ep.Name,
-				},
-			},
-		},
+		endpoints[index].LbEndpoints = append(endpoints[index].LbEndpoints, lbEndpoint)
+	}
+
+	if err := setLocalityPriorities(svc, options.Locality, endpoints); err != nil {
+		return nil, merry.Wrap(err)
 	}
+
+	sortLocalityLbEndpoints(endpoints)
+
+	return &api.ClusterLoadAssignment{
+		ClusterName: options.Name,
+		Endpoints:   endpoints,
+	}, nil
 }
 
 func newSocketAddress(ip string, port uint32) *core.Address {
@@ -9,6 +9,7 @@ import (
 	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
 	envoycache "github.com/envoyproxy/go-control-plane/pkg/cache"
 	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/gogo/protobuf/types"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
@@ -234,4 +235,333 @@ var _ = Describe("NewSnapshot", func() {
 			}))
 		})
 	})
+
+	Describe("given a service with traffic split", func() {
+		newEndpoints := func(name string) *corev1.Endpoints {
+			return &corev1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+				},
+				Subsets: []corev1.EndpointSubset{
+					{
+						Addresses: []corev1.EndpointAddress{
+							{IP: "10.1.1.0"},
+						},
+						Ports: []corev1.EndpointPort{
+							{Port: 80},
+						},
+					},
+				},
+			}
+		}
+
+		BeforeEach(func() {
+			addEndpoint(newEndpoints("foo"), map[string]string{
+				"kds.kubenvoy.dev/domains":       "*",
+				"kds.kubenvoy.dev/traffic_split": "foo-canary=20",
+			})
+			addEndpoint(newEndpoints("foo-canary"), map[string]string{})
+		})
+
+		It("should create clusters for referenced services", func() {
+			Expect(snapshot.Clusters.Items).To(HaveKey("foo"))
+			Expect(snapshot.Clusters.Items).To(HaveKey("foo-canary"))
+			Expect(snapshot.Endpoints.Items).To(HaveKey("foo-canary"))
+		})
+
+		It("should split traffic", func() {
+			routeConf := snapshot.Routes.Items["kds"].(*api.RouteConfiguration)
+			Expect(routeConf.VirtualHosts).To(HaveLen(1))
+			Expect(routeConf.VirtualHosts[0].Routes).To(HaveLen(1))
+			Expect(routeConf.VirtualHosts[0].Routes[0].Action).To(Equal(&route.Route_Route{
+				Route: &route.RouteAction{
+					ClusterSpecifier: &route.RouteAction_WeightedClusters{
+						WeightedClusters: &route.WeightedCluster{
+							Clusters: []*route.WeightedCluster_ClusterWeight{
+								{Name: "foo", Weight: &types.UInt32Value{Value: 80}},
+								{Name: "foo-canary", Weight: &types.UInt32Value{Value: 20}},
+							},
+						},
+					},
+				},
+			}))
+		})
+	})
+
+	Describe("given a service splitting traffic to a missing service", func() {
+		newEndpoints := func(name string, subsets []corev1.EndpointSubset) *corev1.Endpoints {
+			return &corev1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+				},
+				Subsets: subsets,
+			}
+		}
+
+		subsets := []corev1.EndpointSubset{
+			{
+				Addresses: []corev1.EndpointAddress{
+					{IP: "10.1.1.0"},
+				},
+				Ports: []corev1.EndpointPort{
+					{Port: 80},
+				},
+			},
+		}
+
+		BeforeEach(func() {
+			addEndpoint(newEndpoints("foo", subsets), map[string]string{
+				"kds.kubenvoy.dev/domains":       "foo.example.com",
+				"kds.kubenvoy.dev/traffic_split": "foo-canary=20",
+			})
+			addEndpoint(newEndpoints("bar", subsets), map[string]string{
+				"kds.kubenvoy.dev/domains":       "bar.example.com",
+				"kds.kubenvoy.dev/traffic_split": "bar-canary=20",
+			})
+			addEndpoint(newEndpoints("bar-canary", nil), map[string]string{})
+			addEndpoint(newEndpoints("baz", subsets), map[string]string{
+				"kds.kubenvoy.dev/domains": "baz.example.com",
+			})
+		})
+
+		It("should skip clusters of services without endpoints", func() {
+			Expect(snapshot.Clusters.Items).NotTo(HaveKey("bar-canary"))
+			Expect(snapshot.Endpoints.Items).NotTo(HaveKey("bar-canary"))
+		})
+
+		It("should only skip routes of the broken services", func() {
+			routeConf := snapshot.Routes.Items["kds"].(*api.RouteConfiguration)
+			Expect(routeConf.VirtualHosts).To(HaveLen(1))
+			Expect(routeConf.VirtualHosts[0].Domains).To(Equal([]string{"baz.example.com"}))
+			Expect(routeConf.VirtualHosts[0].Routes).To(HaveLen(1))
+			Expect(routeConf.VirtualHosts[0].Routes[0].GetRoute().GetCluster()).To(Equal("baz"))
+		})
+	})
+
+	Describe("given a service mirroring to a missing service", func() {
+		BeforeEach(func() {
+			addEndpoint(&corev1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "foo",
+				},
+				Subsets: []corev1.EndpointSubset{
+					{
+						Addresses: []corev1.EndpointAddress{
+							{IP: "10.1.1.0"},
+						},
+						Ports: []corev1.EndpointPort{
+							{Port: 80},
+						},
+					},
+				},
+			}, map[string]string{
+				"kds.kubenvoy.dev/domains": "*",
+				"kds.kubenvoy.dev/mirror":  "foo-shadow",
+			})
+		})
+
+		It("should drop the mirror policy", func() {
+			routeConf := snapshot.Routes.Items["kds"].(*api.RouteConfiguration)
+			Expect(routeConf.VirtualHosts).To(HaveLen(1))
+			Expect(routeConf.VirtualHosts[0].Routes).To(HaveLen(1))
+			Expect(routeConf.VirtualHosts[0].Routes[0].Action).To(Equal(&route.Route_Route{
+				Route: &route.RouteAction{
+					ClusterSpecifier: &route.RouteAction_Cluster{Cluster: "foo"},
+				},
+			}))
+		})
+
+		It("should not modify the service", func() {
+			obj, _, err := services.GetByKey("foo")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj.(*corev1.Service).Annotations).To(HaveKey("kds.kubenvoy.dev/mirror"))
+		})
+	})
+
+	Describe("given a service with direct response", func() {
+		BeforeEach(func() {
+			Expect(services.Add(&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "maintenance",
+					Annotations: map[string]string{
+						"kds.kubenvoy.dev/domains":                "*",
+						"kds.kubenvoy.dev/direct_response_status": "503",
+					},
+				},
+			})).To(Succeed())
+		})
+
+		It("should not create clusters", func() {
+			Expect(snapshot.Clusters.Items).To(BeEmpty())
+		})
+
+		It("should create routes without endpoints", func() {
+			routeConf := snapshot.Routes.Items["kds"].(*api.RouteConfiguration)
+			Expect(routeConf.VirtualHosts).To(HaveLen(1))
+			Expect(routeConf.VirtualHosts[0].Routes).To(HaveLen(1))
+			Expect(routeConf.VirtualHosts[0].Routes[0].Action).To(Equal(&route.Route_DirectResponse{
+				DirectResponse: &route.DirectResponseAction{
+					Status: 503,
+				},
+			}))
+		})
+	})
+
+	Describe("given a service with TCP proxy ports", func() {
+		BeforeEach(func() {
+			Expect(endpoints.Add(&corev1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "postgres",
+				},
+				Subsets: []corev1.EndpointSubset{
+					{
+						Addresses: []corev1.EndpointAddress{
+							{IP: "10.1.1.0"},
+						},
+						Ports: []corev1.EndpointPort{
+							{Name: "metrics", Port: 9187},
+							{Name: "postgres", Port: 5432},
+						},
+					},
+				},
+			})).To(Succeed())
+			Expect(services.Add(&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "postgres",
+					Annotations: map[string]string{
+						"kds.kubenvoy.dev/tcp_proxy_ports": "15432:postgres",
+					},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{Name: "metrics", Port: 9187},
+						{Name: "postgres", Port: 5432},
+					},
+				},
+			})).To(Succeed())
+		})
+
+		It("should create a cluster for the port", func() {
+			Expect(snapshot.Clusters.Items).To(HaveLen(1))
+			Expect(snapshot.Clusters.Items).To(HaveKey("postgres:15432"))
+		})
+
+		It("should send connections to the service port", func() {
+			cla := snapshot.Endpoints.Items["postgres:15432"].(*api.ClusterLoadAssignment)
+			Expect(cla.Endpoints[0].LbEndpoints[0].GetEndpoint().Address).To(Equal(newSocketAddress("10.1.1.0", 5432)))
+		})
+
+		It("should create a TCP listener without routes", func() {
+			Expect(snapshot.Routes.Items).To(BeEmpty())
+			Expect(snapshot.Listeners.Items).To(HaveLen(1))
+			ln := snapshot.Listeners.Items["postgres:15432"].(*api.Listener)
+			Expect(ln.Address).To(Equal(*newSocketAddress("0.0.0.0", 15432)))
+			Expect(ln.FilterChains[0].Filters[0].Name).To(Equal(util.TCPProxy))
+		})
+	})
+
+	Describe("given a service with TLS passthrough", func() {
+		BeforeEach(func() {
+			addEndpoint(&corev1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "foo",
+				},
+				Subsets: []corev1.EndpointSubset{
+					{
+						Addresses: []corev1.EndpointAddress{
+							{IP: "10.1.1.0"},
+						},
+						Ports: []corev1.EndpointPort{
+							{Port: 443},
+						},
+					},
+				},
+			}, map[string]string{
+				"kds.kubenvoy.dev/domains":         "foo.example.com",
+				"kds.kubenvoy.dev/tls_passthrough": "true",
+			})
+		})
+
+		It("should create a cluster", func() {
+			Expect(snapshot.Clusters.Items).To(HaveKey("foo"))
+		})
+
+		It("should not create routes", func() {
+			Expect(snapshot.Routes.Items).To(BeEmpty())
+		})
+
+		It("should create a TLS listener", func() {
+			Expect(snapshot.Listeners.Items).To(HaveLen(1))
+			ln := snapshot.Listeners.Items["kds-tls"].(*api.Listener)
+			Expect(ln.FilterChains).To(HaveLen(1))
+			Expect(ln.FilterChains[0].FilterChainMatch.ServerNames).To(Equal([]string{"foo.example.com"}))
+		})
+	})
+
+	Describe("given an ExternalName service", func() {
+		BeforeEach(func() {
+			Expect(services.Add(&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "foo",
+					Annotations: map[string]string{
+						"kds.kubenvoy.dev/domains": "*",
+					},
+				},
+				Spec: corev1.ServiceSpec{
+					Type:         corev1.ServiceTypeExternalName,
+					ExternalName: "api.example.com",
+				},
+			})).To(Succeed())
+		})
+
+		It("should create a DNS cluster without endpoints", func() {
+			Expect(snapshot.Endpoints.Items).To(BeEmpty())
+			Expect(snapshot.Clusters.Items).To(HaveKey("foo"))
+			Expect(snapshot.Clusters.Items["foo"].(*api.Cluster).Type).To(Equal(api.Cluster_STRICT_DNS))
+		})
+
+		It("should create routes", func() {
+			routeConf := snapshot.Routes.Items["kds"].(*api.RouteConfiguration)
+			Expect(routeConf.VirtualHosts).To(HaveLen(1))
+			Expect(routeConf.VirtualHosts[0].Routes[0].GetRoute().GetCluster()).To(Equal("foo"))
+		})
+	})
+
+	Describe("given a dual-stack endpoint", func() {
+		BeforeEach(func() {
+			addEndpoint(&corev1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "foo",
+				},
+				Subsets: []corev1.EndpointSubset{
+					{
+						Addresses: []corev1.EndpointAddress{
+							{IP: "10.1.1.0"},
+						},
+						Ports: []corev1.EndpointPort{
+							{Port: 80},
+						},
+					},
+					{
+						Addresses: []corev1.EndpointAddress{
+							{IP: "fd00::1"},
+						},
+						Ports: []corev1.EndpointPort{
+							{Port: 8080},
+						},
+					},
+				},
+			}, map[string]string{
+				"kds.kubenvoy.dev/domains": "*",
+			})
+		})
+
+		It("should include addresses of all subsets", func() {
+			cla := snapshot.Endpoints.Items["foo"].(*api.ClusterLoadAssignment)
+			Expect(cla.Endpoints).To(HaveLen(1))
+			Expect(cla.Endpoints[0].LbEndpoints).To(HaveLen(2))
+			Expect(cla.Endpoints[0].LbEndpoints[0].GetEndpoint().Address).To(Equal(newSocketAddress("10.1.1.0", 80)))
+			Expect(cla.Endpoints[0].LbEndpoints[1].GetEndpoint().Address).To(Equal(newSocketAddress("fd00::1", 8080)))
+		})
+	})
 })
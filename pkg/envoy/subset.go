@@ -0,0 +1,231 @@
+package envoy
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/ansel1/merry"
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const subsetMetadataKey = "envoy.lb"
+
+// subsetRoute sends requests matching the header to endpoints with the labels.
+type subsetRoute struct {
+	Header *route.HeaderMatcher
+	Labels map[string]string
+}
+
+// hasSubsets returns true if subset load balancing is enabled and the service
+// has subset annotations. Annotations are ignored when it's disabled, because
+// endpoints don't have labels of pods in that case.
+func hasSubsets(svc *corev1.Service, conf *config.SubsetsConfig) bool {
+	if !conf.Enabled {
+		return false
+	}
+
+	for _, key := range []string{
+		AnnotationSubsetSelectors,
+		AnnotationSubsetDefault,
+		AnnotationSubsetRoutes,
+	} {
+		if strings.TrimSpace(svc.Annotations[key]) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newLbSubsetConfig returns the subset config of the cluster. Selectors are
+// separated by semicolons, and label keys of a selector are separated by
+// commas. Keys used by subset routes are added as selectors automatically.
+// It should only be used by EDS clusters, whose endpoints have labels.
+func newLbSubsetConfig(svc *corev1.Service, conf *config.SubsetsConfig) (*api.Cluster_LbSubsetConfig, error) {
+	if !hasSubsets(svc, conf) {
+		return nil, nil
+	}
+
+	subsetConf := &api.Cluster_LbSubsetConfig{
+		FallbackPolicy: api.Cluster_LbSubsetConfig_ANY_ENDPOINT,
+	}
+
+	var selectors [][]string
+
+	for _, s := range strings.Split(svc.Annotations[AnnotationSubsetSelectors], ";") {
+		if keys := splitList(s); len(keys) > 0 {
+			selectors = append(selectors, keys)
+		}
+	}
+
+	routes, err := getSubsetRoutes(svc)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	for _, r := range routes {
+		selectors = append(selectors, getSortedKeys(r.Labels))
+	}
+
+	if s := svc.Annotations[AnnotationSubsetDefault]; s != "" {
+		labels, err := parseLabels(svc, AnnotationSubsetDefault, s)
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		subsetConf.FallbackPolicy = api.Cluster_LbSubsetConfig_DEFAULT_SUBSET
+		subsetConf.DefaultSubset = newLabelStruct(labels)
+		selectors = append(selectors, getSortedKeys(labels))
+	}
+
+	seen := map[string]bool{}
+
+	for _, keys := range selectors {
+		sort.Strings(keys)
+		id := strings.Join(keys, ",")
+
+		if seen[id] {
+			continue
+		}
+
+		seen[id] = true
+		subsetConf.SubsetSelectors = append(subsetConf.SubsetSelectors, &api.Cluster_LbSubsetConfig_LbSubsetSelector{
+			Keys: keys,
+		})
+	}
+
+	return subsetConf, nil
+}
+
+// addSubsetRoutes adds a copy of each route to the service for each subset
+// route, which matches the header of the subset route and sends requests to
+// endpoints with the labels. Copies have more matchers, so they are sorted
+// ahead of the original routes.
+func addSubsetRoutes(svc *corev1.Service, conf *config.SubsetsConfig, routes []route.Route) ([]route.Route, error) {
+	if !hasSubsets(svc, conf) {
+		return routes, nil
+	}
+
+	subsetRoutes, err := getSubsetRoutes(svc)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	result := make([]route.Route, 0, len(routes)*(len(subsetRoutes)+1))
+
+	for i := range routes {
+		result = append(result, routes[i])
+
+		// Redirects and direct responses are not sent to endpoints.
+		if routes[i].GetRoute() == nil {
+			continue
+		}
+
+		for _, sr := range subsetRoutes {
+			r := proto.Clone(&routes[i]).(*route.Route)
+			r.Match.Headers = append(r.Match.Headers, sr.Header)
+			r.GetRoute().MetadataMatch = newLbMetadata(sr.Labels)
+			result = append(result, *r)
+		}
+	}
+
+	return result, nil
+}
+
+// getSubsetRoutes parses subset routes in the form of
+// "<header matcher> -> <label>=<value>,...", one route per line.
+func getSubsetRoutes(svc *corev1.Service) ([]subsetRoute, error) {
+	var result []subsetRoute
+
+	for _, line := range strings.Split(svc.Annotations[AnnotationSubsetRoutes], "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, "->", 2)
+
+		if len(parts) != 2 {
+			return nil, newAnnotationError(svc, AnnotationSubsetRoutes).Append("invalid subset route: " + line)
+		}
+
+		header, err := newHeaderMatcher(strings.TrimSpace(parts[0]))
+
+		if err != nil {
+			return nil, merry.WithValue(err, "service", svc.Name)
+		}
+
+		labels, err := parseLabels(svc, AnnotationSubsetRoutes, parts[1])
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		result = append(result, subsetRoute{Header: header, Labels: labels})
+	}
+
+	return result, nil
+}
+
+// parseLabels parses labels in the form of "<label>=<value>", separated by
+// commas.
+func parseLabels(svc *corev1.Service, key, s string) (map[string]string, error) {
+	result := map[string]string{}
+
+	for _, pair := range splitList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, newAnnotationError(svc, key).Append("invalid label: " + pair)
+		}
+
+		result[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	if len(result) == 0 {
+		return nil, newAnnotationError(svc, key).Append("labels are required")
+	}
+
+	return result, nil
+}
+
+func getSortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// newLbMetadata returns metadata used by subset load balancing.
+func newLbMetadata(labels map[string]string) *core.Metadata {
+	return &core.Metadata{
+		FilterMetadata: map[string]*types.Struct{
+			subsetMetadataKey: newLabelStruct(labels),
+		},
+	}
+}
+
+func newLabelStruct(labels map[string]string) *types.Struct {
+	fields := make(map[string]*types.Value, len(labels))
+
+	for k, v := range labels {
+		fields[k] = &types.Value{
+			Kind: &types.Value_StringValue{StringValue: v},
+		}
+	}
+
+	return &types.Struct{Fields: fields}
+}
@@ -0,0 +1,156 @@
+package envoy
+
+import (
+	"github.com/ansel1/merry"
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"github.com/gogo/protobuf/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/tommy351/kubenvoy/pkg/config"
+)
+
+var _ = Describe("newLbSubsetConfig", func() {
+	conf := &config.SubsetsConfig{Enabled: true}
+
+	It("should return nil without subset annotations", func() {
+		Expect(newLbSubsetConfig(newTestService(map[string]string{}), conf)).To(BeNil())
+	})
+
+	It("should return nil when subsets are disabled", func() {
+		Expect(newLbSubsetConfig(newTestService(map[string]string{
+			AnnotationSubsetDefault: "version=v1",
+		}), &config.SubsetsConfig{})).To(BeNil())
+	})
+
+	It("should set selectors", func() {
+		c, err := newLbSubsetConfig(newTestService(map[string]string{
+			AnnotationSubsetSelectors: "version; stage, version",
+		}), conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c).To(Equal(&api.Cluster_LbSubsetConfig{
+			FallbackPolicy: api.Cluster_LbSubsetConfig_ANY_ENDPOINT,
+			SubsetSelectors: []*api.Cluster_LbSubsetConfig_LbSubsetSelector{
+				{Keys: []string{"version"}},
+				{Keys: []string{"stage", "version"}},
+			},
+		}))
+	})
+
+	It("should fall back to the default subset", func() {
+		c, err := newLbSubsetConfig(newTestService(map[string]string{
+			AnnotationSubsetSelectors: "version",
+			AnnotationSubsetDefault:   "version=v1",
+		}), conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c).To(Equal(&api.Cluster_LbSubsetConfig{
+			FallbackPolicy: api.Cluster_LbSubsetConfig_DEFAULT_SUBSET,
+			DefaultSubset:  newLabelStruct(map[string]string{"version": "v1"}),
+			SubsetSelectors: []*api.Cluster_LbSubsetConfig_LbSubsetSelector{
+				{Keys: []string{"version"}},
+			},
+		}))
+	})
+
+	It("should add selectors of subset routes", func() {
+		c, err := newLbSubsetConfig(newTestService(map[string]string{
+			AnnotationSubsetRoutes: "x-canary=true -> version=v2,stage=canary",
+		}), conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.SubsetSelectors).To(Equal([]*api.Cluster_LbSubsetConfig_LbSubsetSelector{
+			{Keys: []string{"stage", "version"}},
+		}))
+	})
+})
+
+var _ = Describe("getSubsetRoutes", func() {
+	It("should parse a route per line", func() {
+		routes, err := getSubsetRoutes(newTestService(map[string]string{
+			AnnotationSubsetRoutes: "x-canary=true -> version=v2\nx-beta -> stage=beta",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).To(Equal([]subsetRoute{
+			{
+				Header: &route.HeaderMatcher{
+					Name:                 "x-canary",
+					HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "true"},
+				},
+				Labels: map[string]string{"version": "v2"},
+			},
+			{
+				Header: &route.HeaderMatcher{
+					Name:                 "x-beta",
+					HeaderMatchSpecifier: &route.HeaderMatcher_PresentMatch{PresentMatch: true},
+				},
+				Labels: map[string]string{"stage": "beta"},
+			},
+		}))
+	})
+
+	DescribeTable("invalid routes", func(value string) {
+		_, err := getSubsetRoutes(newTestService(map[string]string{
+			AnnotationSubsetRoutes: value,
+		}))
+		Expect(merry.Is(err, ErrInvalidAnnotation)).To(BeTrue())
+	},
+		Entry("without labels", "x-canary=true"),
+		Entry("empty labels", "x-canary=true ->"),
+		Entry("invalid labels", "x-canary=true -> v2"),
+	)
+})
+
+var _ = Describe("newLbMetadata", func() {
+	It("should set labels as envoy.lb metadata", func() {
+		Expect(newLbMetadata(map[string]string{"version": "v1"}).FilterMetadata).To(Equal(map[string]*types.Struct{
+			"envoy.lb": {
+				Fields: map[string]*types.Value{
+					"version": {Kind: &types.Value_StringValue{StringValue: "v1"}},
+				},
+			},
+		}))
+	})
+})
+
+var _ = Describe("addSubsetRoutes", func() {
+	var routes []route.Route
+
+	BeforeEach(func() {
+		routes = []route.Route{
+			{
+				Match:  route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"}},
+				Action: &route.Route_Route{Route: &route.RouteAction{}},
+			},
+		}
+	})
+
+	It("should add routes matching subsets", func() {
+		result, err := addSubsetRoutes(newTestService(map[string]string{
+			AnnotationSubsetRoutes: "x-canary=true -> version=v2",
+		}), &config.SubsetsConfig{Enabled: true}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(HaveLen(2))
+		Expect(result[0].Match.Headers).To(BeEmpty())
+		Expect(result[0].GetRoute().MetadataMatch).To(BeNil())
+		Expect(result[1].Match.Headers).To(HaveLen(1))
+		Expect(result[1].Match.GetPrefix()).To(Equal("/"))
+		Expect(result[1].GetRoute().MetadataMatch).To(Equal(newLbMetadata(map[string]string{"version": "v2"})))
+	})
+
+	It("should not add routes when subsets are disabled", func() {
+		result, err := addSubsetRoutes(newTestService(map[string]string{
+			AnnotationSubsetRoutes: "x-canary=true -> version=v2",
+		}), &config.SubsetsConfig{}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(routes))
+	})
+
+	It("should skip redirect routes", func() {
+		routes[0].Action = &route.Route_Redirect{Redirect: &route.RedirectAction{}}
+		result, err := addSubsetRoutes(newTestService(map[string]string{
+			AnnotationSubsetRoutes: "x-canary=true -> version=v2",
+		}), &config.SubsetsConfig{Enabled: true}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,195 @@
+package envoy
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ansel1/merry"
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	fileaccesslog "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v2"
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/filter/accesslog/v2"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/gogo/protobuf/types"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// tcpProxyPort maps a port of a service to a dedicated listener port.
+type tcpProxyPort struct {
+	ListenerPort uint32
+	ServicePort  string
+}
+
+// getTCPProxies returns TCP proxy ports of services keyed by service names.
+// Listener ports must be unique across all services.
+func getTCPProxies(svcMap map[string]*corev1.Service) (map[string][]tcpProxyPort, error) {
+	result := map[string][]tcpProxyPort{}
+	listenerPorts := map[uint32]bool{httpListenerPort: true, tlsListenerPort: true}
+	names := make([]string, 0, len(svcMap))
+
+	for name := range svcMap {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		svc := svcMap[name]
+		ports, err := getTCPProxyPorts(svc)
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		for _, port := range ports {
+			if listenerPorts[port.ListenerPort] {
+				return nil, ErrDuplicateListenerPort.Here().
+					WithValue("service", svc.Name).
+					WithValue("port", port.ListenerPort)
+			}
+
+			listenerPorts[port.ListenerPort] = true
+		}
+
+		if len(ports) > 0 {
+			result[name] = ports
+		}
+	}
+
+	return result, nil
+}
+
+// getTCPProxyPorts parses the TCP proxy annotation in the form of
+// "<listener port>:<service port>", separated by commas. Service ports can be
+// either names or numbers.
+func getTCPProxyPorts(svc *corev1.Service) ([]tcpProxyPort, error) {
+	var result []tcpProxyPort
+
+	for _, s := range getListAnnotation(svc, AnnotationTCPProxyPorts) {
+		parts := strings.SplitN(s, ":", 2)
+
+		if len(parts) != 2 {
+			return nil, newAnnotationError(svc, AnnotationTCPProxyPorts).Append("invalid port mapping: " + s)
+		}
+
+		listenerPort, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+
+		if err != nil || listenerPort == 0 {
+			return nil, newAnnotationError(svc, AnnotationTCPProxyPorts).Append("invalid listener port: " + parts[0])
+		}
+
+		port := getServicePort(svc, strings.TrimSpace(parts[1]))
+
+		if port == nil {
+			return nil, ErrNoPort.Here().WithValue("service", svc.Name).WithValue("port", parts[1])
+		}
+
+		result = append(result, tcpProxyPort{
+			ListenerPort: uint32(listenerPort),
+			ServicePort:  port.Name,
+		})
+	}
+
+	return result, nil
+}
+
+func getServicePort(svc *corev1.Service, s string) *corev1.ServicePort {
+	for i, p := range svc.Spec.Ports {
+		if p.Name == s || strconv.Itoa(int(p.Port)) == s {
+			return &svc.Spec.Ports[i]
+		}
+	}
+
+	return nil
+}
+
+func getTCPProxyClusterName(svc *corev1.Service, port tcpProxyPort) string {
+	return svc.Name + ":" + strconv.FormatUint(uint64(port.ListenerPort), 10)
+}
+
+func newTCPListener(svc *corev1.Service, port tcpProxyPort, conf *config.EnvoyConfig) (*api.Listener, error) {
+	name := getTCPProxyClusterName(svc, port)
+	proxyConfig, err := newTCPProxyConfig(svc, name, &conf.TCPProxy)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	return &api.Listener{
+		Name:    name,
+		Address: newListenerAddress(&conf.Listener, port.ListenerPort),
+		FilterChains: []listener.FilterChain{
+			{
+				Filters: []listener.Filter{
+					{
+						Name: util.TCPProxy,
+						ConfigType: &listener.Filter_Config{
+							Config: proxyConfig,
+						},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// newTCPProxyConfig returns the config of the TCP proxy filter which sends
+// connections to the given cluster.
+func newTCPProxyConfig(svc *corev1.Service, cluster string, conf *config.TCPProxyConfig) (*types.Struct, error) {
+	proxy := &tcp.TcpProxy{
+		StatPrefix: cluster,
+		ClusterSpecifier: &tcp.TcpProxy_Cluster{
+			Cluster: cluster,
+		},
+	}
+
+	idleTimeout, err := getDurationAnnotation(svc, AnnotationTCPIdleTimeout)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if idleTimeout != nil {
+		proxy.IdleTimeout = idleTimeout
+	} else if conf.IdleTimeout > 0 {
+		proxy.IdleTimeout = durationPtr(conf.IdleTimeout)
+	}
+
+	if conf.AccessLogPath != "" {
+		accessLog, err := newFileAccessLog(conf.AccessLogPath)
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		proxy.AccessLog = []*accesslog.AccessLog{accessLog}
+	}
+
+	result, err := util.MessageToStruct(proxy)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	return result, nil
+}
+
+func newFileAccessLog(path string) (*accesslog.AccessLog, error) {
+	logConfig, err := util.MessageToStruct(&fileaccesslog.FileAccessLog{
+		Path: path,
+	})
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	return &accesslog.AccessLog{
+		Name: util.FileAccessLog,
+		ConfigType: &accesslog.AccessLog_Config{
+			Config: logConfig,
+		},
+	}, nil
+}
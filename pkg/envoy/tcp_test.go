@@ -0,0 +1,134 @@
+package envoy
+
+import (
+	"time"
+
+	"github.com/ansel1/merry"
+	fileaccesslog "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v2"
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/filter/accesslog/v2"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestTCPService(name, ports string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				AnnotationTCPProxyPorts: ports,
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "redis", Port: 6379},
+				{Name: "sentinel", Port: 26379},
+			},
+		},
+	}
+}
+
+var _ = Describe("getTCPProxyPorts", func() {
+	It("should return nothing by default", func() {
+		Expect(getTCPProxyPorts(newTestService(map[string]string{}))).To(BeEmpty())
+	})
+
+	It("should resolve service ports by names and numbers", func() {
+		Expect(getTCPProxyPorts(newTestTCPService("foo", "16379:redis, 26379:26379"))).To(Equal([]tcpProxyPort{
+			{ListenerPort: 16379, ServicePort: "redis"},
+			{ListenerPort: 26379, ServicePort: "sentinel"},
+		}))
+	})
+
+	DescribeTable("invalid annotations", func(value string) {
+		_, err := getTCPProxyPorts(newTestTCPService("foo", value))
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("no service port", "16379"),
+		Entry("invalid listener port", "foo:redis"),
+		Entry("listener port out of range", "70000:redis"),
+		Entry("unknown service port", "16379:http"),
+	)
+})
+
+var _ = Describe("getTCPProxies", func() {
+	It("should return ports keyed by service names", func() {
+		Expect(getTCPProxies(map[string]*corev1.Service{
+			"foo": newTestTCPService("foo", "16379:redis"),
+			"bar": newTestService(map[string]string{}),
+		})).To(Equal(map[string][]tcpProxyPort{
+			"foo": {{ListenerPort: 16379, ServicePort: "redis"}},
+		}))
+	})
+
+	It("should not allow duplicate listener ports", func() {
+		_, err := getTCPProxies(map[string]*corev1.Service{
+			"foo": newTestTCPService("foo", "16379:redis"),
+			"bar": newTestTCPService("bar", "16379:redis"),
+		})
+		Expect(merry.Is(err, ErrDuplicateListenerPort)).To(BeTrue())
+	})
+
+	It("should not allow the port of the HTTP listener", func() {
+		_, err := getTCPProxies(map[string]*corev1.Service{
+			"foo": newTestTCPService("foo", "10000:redis"),
+		})
+		Expect(merry.Is(err, ErrDuplicateListenerPort)).To(BeTrue())
+	})
+})
+
+var _ = Describe("newTCPProxyConfig", func() {
+	var (
+		annotations map[string]string
+		conf        *config.TCPProxyConfig
+	)
+
+	BeforeEach(func() {
+		annotations = map[string]string{}
+		conf = new(config.TCPProxyConfig)
+	})
+
+	mustNewTCPProxyConfig := func(proxy *tcp.TcpProxy) {
+		expected, err := util.MessageToStruct(proxy)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(newTCPProxyConfig(newTestService(annotations), "foo:16379", conf)).To(Equal(expected))
+	}
+
+	It("should send connections to the cluster", func() {
+		mustNewTCPProxyConfig(&tcp.TcpProxy{
+			StatPrefix:       "foo:16379",
+			ClusterSpecifier: &tcp.TcpProxy_Cluster{Cluster: "foo:16379"},
+		})
+	})
+
+	It("should prefer idle timeout in annotations", func() {
+		annotations[AnnotationTCPIdleTimeout] = "5m"
+		conf.IdleTimeout = time.Hour
+		mustNewTCPProxyConfig(&tcp.TcpProxy{
+			StatPrefix:       "foo:16379",
+			ClusterSpecifier: &tcp.TcpProxy_Cluster{Cluster: "foo:16379"},
+			IdleTimeout:      durationPtr(5 * time.Minute),
+		})
+	})
+
+	It("should set access log", func() {
+		conf.AccessLogPath = "/dev/stdout"
+		logConfig, err := util.MessageToStruct(&fileaccesslog.FileAccessLog{Path: "/dev/stdout"})
+		Expect(err).NotTo(HaveOccurred())
+		mustNewTCPProxyConfig(&tcp.TcpProxy{
+			StatPrefix:       "foo:16379",
+			ClusterSpecifier: &tcp.TcpProxy_Cluster{Cluster: "foo:16379"},
+			AccessLog: []*accesslog.AccessLog{
+				{
+					Name:       util.FileAccessLog,
+					ConfigType: &accesslog.AccessLog_Config{Config: logConfig},
+				},
+			},
+		})
+	})
+})
@@ -0,0 +1,83 @@
+package envoy
+
+import (
+	"strconv"
+
+	"github.com/ansel1/merry"
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const tlsListenerPort = 10443
+
+func isTLSPassthrough(svc *corev1.Service) (bool, error) {
+	s, ok := svc.Annotations[AnnotationTLSPassthrough]
+
+	if !ok {
+		return false, nil
+	}
+
+	v, err := strconv.ParseBool(s)
+
+	if err != nil {
+		return false, newAnnotationError(svc, AnnotationTLSPassthrough).Append(err.Error())
+	}
+
+	return v, nil
+}
+
+// newTLSPassthroughListener returns a listener which sends TLS connections to
+// services by SNI without terminating them. Each service has a filter chain
+// matching its domain, and the "*" domain matches all other server names.
+func newTLSPassthroughListener(services []*corev1.Service, conf *config.EnvoyConfig) (*api.Listener, error) {
+	var chains []listener.FilterChain
+	serverNames := map[string]bool{}
+
+	for _, svc := range services {
+		domain := svc.Annotations[AnnotationDomains]
+
+		if serverNames[domain] {
+			return nil, ErrDuplicateServerName.Here().
+				WithValue("service", svc.Name).
+				WithValue("domain", domain)
+		}
+
+		serverNames[domain] = true
+		proxyConfig, err := newTCPProxyConfig(svc, svc.Name, &conf.TCPProxy)
+
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+
+		chain := listener.FilterChain{
+			Filters: []listener.Filter{
+				{
+					Name: util.TCPProxy,
+					ConfigType: &listener.Filter_Config{
+						Config: proxyConfig,
+					},
+				},
+			},
+		}
+
+		if domain != "*" {
+			chain.FilterChainMatch = &listener.FilterChainMatch{
+				ServerNames: []string{domain},
+			}
+		}
+
+		chains = append(chains, chain)
+	}
+
+	return &api.Listener{
+		Name:    "kds-tls",
+		Address: newListenerAddress(&conf.Listener, tlsListenerPort),
+		ListenerFilters: []listener.ListenerFilter{
+			{Name: util.TlsInspector},
+		},
+		FilterChains: chains,
+	}, nil
+}
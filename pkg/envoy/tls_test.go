@@ -0,0 +1,78 @@
+package envoy
+
+import (
+	"github.com/ansel1/merry"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("newTLSPassthroughListener", func() {
+	newService := func(name, domain string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Annotations: map[string]string{
+					AnnotationDomains:        domain,
+					AnnotationTLSPassthrough: "true",
+				},
+			},
+		}
+	}
+
+	It("should inspect TLS connections", func() {
+		ln, err := newTLSPassthroughListener([]*corev1.Service{newService("foo", "foo.example.com")}, new(config.EnvoyConfig))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ln.Address).To(Equal(*newSocketAddress("0.0.0.0", tlsListenerPort)))
+		Expect(ln.ListenerFilters).To(Equal([]listener.ListenerFilter{
+			{Name: util.TlsInspector},
+		}))
+	})
+
+	It("should create a filter chain for each server name", func() {
+		conf := new(config.EnvoyConfig)
+		fooConfig, err := newTCPProxyConfig(newService("foo", "foo.example.com"), "foo", &conf.TCPProxy)
+		Expect(err).NotTo(HaveOccurred())
+		barConfig, err := newTCPProxyConfig(newService("bar", "*"), "bar", &conf.TCPProxy)
+		Expect(err).NotTo(HaveOccurred())
+
+		ln, err := newTLSPassthroughListener([]*corev1.Service{
+			newService("foo", "foo.example.com"),
+			newService("bar", "*"),
+		}, conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ln.FilterChains).To(Equal([]listener.FilterChain{
+			{
+				FilterChainMatch: &listener.FilterChainMatch{
+					ServerNames: []string{"foo.example.com"},
+				},
+				Filters: []listener.Filter{
+					{
+						Name:       util.TCPProxy,
+						ConfigType: &listener.Filter_Config{Config: fooConfig},
+					},
+				},
+			},
+			{
+				Filters: []listener.Filter{
+					{
+						Name:       util.TCPProxy,
+						ConfigType: &listener.Filter_Config{Config: barConfig},
+					},
+				},
+			},
+		}))
+	})
+
+	It("should not allow duplicate server names", func() {
+		_, err := newTLSPassthroughListener([]*corev1.Service{
+			newService("foo", "foo.example.com"),
+			newService("bar", "foo.example.com"),
+		}, new(config.EnvoyConfig))
+		Expect(merry.Is(err, ErrDuplicateServerName)).To(BeTrue())
+	})
+})
@@ -0,0 +1,74 @@
+package envoy
+
+import (
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/gogo/protobuf/types"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// setRouteUpgrades enables upgrades set in annotations on routes, and sets
+// the idle timeout of routes with upgrades.
+func setRouteUpgrades(svc *corev1.Service, conf *config.UpgradeConfig, routes []route.Route) {
+	upgrades := getListAnnotation(svc, AnnotationUpgradeTypes)
+
+	for i := range routes {
+		action := routes[i].GetRoute()
+
+		if action == nil {
+			continue
+		}
+
+		for _, t := range upgrades {
+			action.UpgradeConfigs = append(action.UpgradeConfigs, &route.RouteAction_UpgradeConfig{
+				UpgradeType: t,
+				Enabled:     &types.BoolValue{Value: true},
+			})
+		}
+
+		if len(upgrades)+len(conf.Types) > 0 && action.IdleTimeout == nil && conf.IdleTimeout > 0 {
+			action.IdleTimeout = durationPtr(conf.IdleTimeout)
+		}
+	}
+}
+
+// newUpgradeConfigs returns upgrades of the HTTP connection manager. Upgrades
+// in config are enabled on all routes, while upgrades only used by some routes
+// are disabled by default and enabled in those routes.
+func newUpgradeConfigs(routeConf *api.RouteConfiguration, conf *config.UpgradeConfig) []*hcm.HttpConnectionManager_UpgradeConfig {
+	var result []*hcm.HttpConnectionManager_UpgradeConfig
+	added := map[string]bool{}
+
+	for _, t := range conf.Types {
+		if !added[t] {
+			added[t] = true
+			result = append(result, &hcm.HttpConnectionManager_UpgradeConfig{
+				UpgradeType: t,
+			})
+		}
+	}
+
+	for _, vh := range routeConf.VirtualHosts {
+		for i := range vh.Routes {
+			action := vh.Routes[i].GetRoute()
+
+			if action == nil {
+				continue
+			}
+
+			for _, u := range action.UpgradeConfigs {
+				if !added[u.UpgradeType] {
+					added[u.UpgradeType] = true
+					result = append(result, &hcm.HttpConnectionManager_UpgradeConfig{
+						UpgradeType: u.UpgradeType,
+						Enabled:     &types.BoolValue{Value: false},
+					})
+				}
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,87 @@
+package envoy
+
+import (
+	"time"
+
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/gogo/protobuf/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tommy351/kubenvoy/pkg/config"
+)
+
+var _ = Describe("setRouteUpgrades", func() {
+	var routes []route.Route
+
+	BeforeEach(func() {
+		routes = []route.Route{
+			{
+				Action: &route.Route_Route{
+					Route: &route.RouteAction{},
+				},
+			},
+		}
+	})
+
+	It("should not set upgrades by default", func() {
+		setRouteUpgrades(newTestService(map[string]string{}), &config.UpgradeConfig{
+			IdleTimeout: time.Hour,
+		}, routes)
+		Expect(routes[0].GetRoute()).To(Equal(&route.RouteAction{}))
+	})
+
+	It("should enable upgrades set in annotations", func() {
+		setRouteUpgrades(newTestService(map[string]string{
+			AnnotationUpgradeTypes: "websocket",
+		}), &config.UpgradeConfig{
+			IdleTimeout: time.Hour,
+		}, routes)
+		Expect(routes[0].GetRoute()).To(Equal(&route.RouteAction{
+			IdleTimeout: durationPtr(time.Hour),
+			UpgradeConfigs: []*route.RouteAction_UpgradeConfig{
+				{UpgradeType: "websocket", Enabled: &types.BoolValue{Value: true}},
+			},
+		}))
+	})
+
+	It("should not override idle timeout of routes", func() {
+		routes[0].GetRoute().IdleTimeout = durationPtr(time.Minute)
+		setRouteUpgrades(newTestService(map[string]string{}), &config.UpgradeConfig{
+			Types:       []string{"websocket"},
+			IdleTimeout: time.Hour,
+		}, routes)
+		Expect(routes[0].GetRoute().IdleTimeout).To(Equal(durationPtr(time.Minute)))
+	})
+})
+
+var _ = Describe("newUpgradeConfigs", func() {
+	It("should enable upgrades in config and disable upgrades only used by routes", func() {
+		routeConf := &api.RouteConfiguration{
+			VirtualHosts: []route.VirtualHost{
+				{
+					Routes: []route.Route{
+						{
+							Action: &route.Route_Route{
+								Route: &route.RouteAction{
+									UpgradeConfigs: []*route.RouteAction_UpgradeConfig{
+										{UpgradeType: "websocket"},
+										{UpgradeType: "h2c"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		Expect(newUpgradeConfigs(routeConf, &config.UpgradeConfig{
+			Types: []string{"websocket"},
+		})).To(Equal([]*hcm.HttpConnectionManager_UpgradeConfig{
+			{UpgradeType: "websocket"},
+			{UpgradeType: "h2c", Enabled: &types.BoolValue{Value: false}},
+		}))
+	})
+})
@@ -0,0 +1,174 @@
+package envoy
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/gogo/protobuf/types"
+	"github.com/rs/zerolog"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	MinEndpointWeight = 1
+	MaxEndpointWeight = 128
+)
+
+// getAddressPod returns the pod an address refers to, or nil if the pod is not
+// found.
+func getAddressPod(addr *corev1.EndpointAddress, pods cache.Store) (*corev1.Pod, error) {
+	ref := addr.TargetRef
+
+	if pods == nil || ref == nil || ref.Kind != "Pod" {
+		return nil, nil
+	}
+
+	obj, exists, err := pods.GetByKey(ref.Namespace + "/" + ref.Name)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if !exists {
+		return nil, nil
+	}
+
+	pod, _ := obj.(*corev1.Pod)
+	return pod, nil
+}
+
+// getEndpointWeight returns the weight of a pod. Weights are not set when
+// neither the annotation nor the default weight is given, unless the pod is in
+// slow start. Invalid annotations are logged and ignored, because annotations
+// of pods are not validated by services and must not fail the whole snapshot.
+func getEndpointWeight(pod *corev1.Pod, conf *config.WeightsConfig, now time.Time, logger *zerolog.Logger) *types.UInt32Value {
+	weight := conf.DefaultWeight
+
+	if weight == 0 {
+		weight = MinEndpointWeight
+	}
+
+	s, ok := pod.Annotations[AnnotationWeight]
+
+	if ok {
+		v, err := strconv.ParseUint(s, 10, 32)
+
+		if err != nil || v < MinEndpointWeight || v > MaxEndpointWeight {
+			logger.Warn().
+				Str("pod", pod.Name).
+				Str("annotation", AnnotationWeight).
+				Str("value", s).
+				Msg("Ignored invalid endpoint weight")
+			ok = false
+		} else {
+			weight = uint32(v)
+		}
+	}
+
+	elapsed, slowStart := getSlowStartElapsed(pod, conf, now)
+
+	if slowStart {
+		weight = uint32(float64(weight) * elapsed.Seconds() / conf.SlowStartWindow.Seconds())
+
+		if weight < MinEndpointWeight {
+			weight = MinEndpointWeight
+		}
+	} else if !ok && conf.DefaultWeight == 0 {
+		return nil
+	}
+
+	return &types.UInt32Value{Value: weight}
+}
+
+// getSlowStartElapsed returns the time since the pod became ready, and
+// returns false if the pod is not in the slow start window.
+func getSlowStartElapsed(pod *corev1.Pod, conf *config.WeightsConfig, now time.Time) (time.Duration, bool) {
+	if conf.SlowStartWindow <= 0 {
+		return 0, false
+	}
+
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type != corev1.PodReady || cond.Status != corev1.ConditionTrue {
+			continue
+		}
+
+		elapsed := now.Sub(cond.LastTransitionTime.Time)
+		return elapsed, elapsed >= 0 && elapsed < conf.SlowStartWindow
+	}
+
+	return 0, false
+}
+
+// SlowStartVersion returns a version of weights of pods in slow start behind
+// services with clusters. Weights are increased in steps, so snapshots only
+// have to be rebuilt when the version changes. It returns an empty string if
+// no such pods exist.
+func SlowStartVersion(options *SnapshotOptions) (string, error) {
+	conf := options.Config
+
+	if options.Pods == nil || conf == nil || !conf.Weights.Enabled || conf.Weights.SlowStartWindow <= 0 {
+		return "", nil
+	}
+
+	backends, err := getBackends(getExposedServices(getServiceMap(options.Services)), conf)
+
+	if err != nil {
+		return "", merry.Wrap(err)
+	}
+
+	epList, err := listEndpoints(options)
+
+	if err != nil {
+		return "", merry.Wrap(err)
+	}
+
+	now := options.getTime()
+	logger := zerolog.Nop()
+	var weights []string
+
+	for _, ep := range epList {
+		if !backends[ep.Name] {
+			continue
+		}
+
+		for _, subset := range ep.Subsets {
+			for _, addresses := range [][]corev1.EndpointAddress{subset.Addresses, subset.NotReadyAddresses} {
+				for i := range addresses {
+					pod, err := getAddressPod(&addresses[i], options.Pods)
+
+					if err != nil {
+						return "", merry.Wrap(err)
+					}
+
+					if pod == nil {
+						continue
+					}
+
+					if _, ok := getSlowStartElapsed(pod, &conf.Weights, now); !ok {
+						continue
+					}
+
+					// Invalid annotations are logged when the snapshot is built.
+					weight := getEndpointWeight(pod, &conf.Weights, now, &logger)
+					weights = append(weights, pod.Namespace+"/"+pod.Name+"="+strconv.FormatUint(uint64(weight.Value), 10))
+				}
+			}
+		}
+	}
+
+	if len(weights) == 0 {
+		return "", nil
+	}
+
+	sort.Strings(weights)
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(strings.Join(weights, ",")))
+
+	return strconv.FormatUint(h.Sum64(), 16), nil
+}
@@ -0,0 +1,240 @@
+package envoy
+
+import (
+	"time"
+
+	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/protobuf/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+	"github.com/tommy351/kubenvoy/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestPod(annotations map[string]string, readyAt time.Time) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo-1",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Status: corev1.PodStatus{
+			Conditions: []corev1.PodCondition{
+				{
+					Type:               corev1.PodReady,
+					Status:             corev1.ConditionTrue,
+					LastTransitionTime: metav1.NewTime(readyAt),
+				},
+			},
+		},
+	}
+}
+
+var _ = Describe("getAddressPod", func() {
+	var pods cache.Store
+
+	BeforeEach(func() {
+		pods = cache.NewStore(cache.MetaNamespaceKeyFunc)
+		Expect(pods.Add(newTestPod(nil, time.Now()))).To(Succeed())
+	})
+
+	It("should find the pod of the target reference", func() {
+		pod, err := getAddressPod(&corev1.EndpointAddress{
+			TargetRef: &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "foo-1"},
+		}, pods)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pod.Name).To(Equal("foo-1"))
+	})
+
+	It("should return nil without target references", func() {
+		Expect(getAddressPod(&corev1.EndpointAddress{}, pods)).To(BeNil())
+	})
+
+	It("should return nil when the pod is not found", func() {
+		Expect(getAddressPod(&corev1.EndpointAddress{
+			TargetRef: &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "foo-2"},
+		}, pods)).To(BeNil())
+	})
+})
+
+var _ = Describe("getEndpointWeight", func() {
+	now := time.Now()
+	readyAt := now.Add(-time.Hour)
+	logger := zerolog.Nop()
+
+	It("should not set weights by default", func() {
+		Expect(getEndpointWeight(newTestPod(nil, readyAt), &config.WeightsConfig{}, now, &logger)).To(BeNil())
+	})
+
+	It("should read weights from annotations", func() {
+		Expect(getEndpointWeight(newTestPod(map[string]string{
+			AnnotationWeight: "20",
+		}, readyAt), &config.WeightsConfig{}, now, &logger)).To(Equal(&types.UInt32Value{Value: 20}))
+	})
+
+	It("should use the default weight", func() {
+		Expect(getEndpointWeight(newTestPod(nil, readyAt), &config.WeightsConfig{
+			DefaultWeight: 10,
+		}, now, &logger)).To(Equal(&types.UInt32Value{Value: 10}))
+	})
+
+	It("should increase weights in the slow start window", func() {
+		Expect(getEndpointWeight(newTestPod(map[string]string{
+			AnnotationWeight: "100",
+		}, now.Add(-15*time.Second)), &config.WeightsConfig{
+			SlowStartWindow: time.Minute,
+		}, now, &logger)).To(Equal(&types.UInt32Value{Value: 25}))
+	})
+
+	It("should use the minimum weight when slow start begins", func() {
+		Expect(getEndpointWeight(newTestPod(nil, now), &config.WeightsConfig{
+			SlowStartWindow: time.Minute,
+		}, now, &logger)).To(Equal(&types.UInt32Value{Value: MinEndpointWeight}))
+	})
+
+	DescribeTable("should ignore invalid annotations", func(value string) {
+		Expect(getEndpointWeight(newTestPod(map[string]string{
+			AnnotationWeight: value,
+		}, readyAt), &config.WeightsConfig{
+			DefaultWeight: 10,
+		}, now, &logger)).To(Equal(&types.UInt32Value{Value: 10}))
+	},
+		Entry("not a number", "foo"),
+		Entry("zero", "0"),
+		Entry("too large", "129"),
+	)
+})
+
+var _ = Describe("SlowStartVersion", func() {
+	var (
+		endpoints, services, pods cache.Store
+		options                   *SnapshotOptions
+		readyAt                   time.Time
+	)
+
+	BeforeEach(func() {
+		endpoints = cache.NewStore(cache.MetaNamespaceKeyFunc)
+		services = cache.NewStore(cache.MetaNamespaceKeyFunc)
+		pods = cache.NewStore(cache.MetaNamespaceKeyFunc)
+		readyAt = time.Now()
+		options = &SnapshotOptions{
+			Endpoints: endpoints,
+			Services:  services,
+			Pods:      pods,
+			Config: &config.EnvoyConfig{
+				Weights: config.WeightsConfig{
+					Enabled:         true,
+					DefaultWeight:   100,
+					SlowStartWindow: 100 * time.Second,
+				},
+			},
+		}
+
+		Expect(services.Add(&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "foo",
+				Namespace:   "default",
+				Annotations: map[string]string{AnnotationDomains: "foo.example.com"},
+			},
+		})).To(Succeed())
+		Expect(endpoints.Add(&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+			Subsets: []corev1.EndpointSubset{
+				{
+					Addresses: []corev1.EndpointAddress{
+						{
+							IP:        "10.1.1.0",
+							TargetRef: &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "foo-1"},
+						},
+					},
+					Ports: []corev1.EndpointPort{{Port: 80}},
+				},
+			},
+		})).To(Succeed())
+		Expect(pods.Add(newTestPod(nil, readyAt))).To(Succeed())
+	})
+
+	versionAt := func(elapsed time.Duration) string {
+		options.Time = readyAt.Add(elapsed)
+		v, err := SlowStartVersion(options)
+		Expect(err).NotTo(HaveOccurred())
+		return v
+	}
+
+	It("should return a version when a pod is in slow start", func() {
+		Expect(versionAt(30 * time.Second)).NotTo(BeEmpty())
+	})
+
+	It("should not change until the weight changes", func() {
+		Expect(versionAt(30 * time.Second)).To(Equal(versionAt(30*time.Second + 500*time.Millisecond)))
+		Expect(versionAt(30 * time.Second)).NotTo(Equal(versionAt(31 * time.Second)))
+	})
+
+	It("should return an empty string after slow start", func() {
+		Expect(versionAt(time.Hour)).To(BeEmpty())
+	})
+
+	It("should ignore pods of services which are not exposed", func() {
+		obj, _, err := services.GetByKey("default/foo")
+		Expect(err).NotTo(HaveOccurred())
+		svc := obj.(*corev1.Service).DeepCopy()
+		svc.Annotations = nil
+		Expect(services.Update(svc)).To(Succeed())
+		Expect(versionAt(30 * time.Second)).To(BeEmpty())
+	})
+
+	It("should return an empty string when weights are disabled", func() {
+		options.Config.Weights.Enabled = false
+		Expect(versionAt(30 * time.Second)).To(BeEmpty())
+	})
+})
+
+var _ = Describe("NewSnapshot with weights", func() {
+	It("should not fail when a pod has an invalid weight", func() {
+		endpoints := cache.NewStore(cache.MetaNamespaceKeyFunc)
+		services := cache.NewStore(cache.MetaNamespaceKeyFunc)
+		pods := cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+		Expect(services.Add(&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "foo",
+				Namespace:   "default",
+				Annotations: map[string]string{AnnotationDomains: "foo.example.com"},
+			},
+		})).To(Succeed())
+		Expect(endpoints.Add(&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+			Subsets: []corev1.EndpointSubset{
+				{
+					Addresses: []corev1.EndpointAddress{
+						{
+							IP:        "10.1.1.0",
+							TargetRef: &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "foo-1"},
+						},
+					},
+					Ports: []corev1.EndpointPort{{Port: 80}},
+				},
+			},
+		})).To(Succeed())
+		Expect(pods.Add(newTestPod(map[string]string{
+			AnnotationWeight: "abc",
+		}, time.Now().Add(-time.Hour)))).To(Succeed())
+
+		snapshot, err := NewSnapshot(&SnapshotOptions{
+			Endpoints: endpoints,
+			Services:  services,
+			Pods:      pods,
+			Config: &config.EnvoyConfig{
+				Weights: config.WeightsConfig{Enabled: true, DefaultWeight: 10},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		cla := snapshot.Endpoints.Items["foo"].(*api.ClusterLoadAssignment)
+		Expect(cla.Endpoints[0].LbEndpoints[0].LoadBalancingWeight).To(Equal(&types.UInt32Value{Value: 10}))
+	})
+})
@@ -6,6 +6,9 @@ import (
 
 	"github.com/ansel1/merry"
 	"github.com/tommy351/kubenvoy/pkg/config"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	corev1 "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
@@ -17,6 +20,18 @@ import (
 type Client interface {
 	WatchEndpoints(ctx context.Context, opts *WatchEndpointsOptions) cache.SharedIndexInformer
 	WatchService(ctx context.Context, opts *WatchServiceOptions) cache.SharedIndexInformer
+	WatchNodes(ctx context.Context, opts *WatchNodesOptions) cache.SharedIndexInformer
+	WatchPods(ctx context.Context, opts *WatchPodsOptions) cache.SharedIndexInformer
+	WatchEndpointSlices(ctx context.Context, opts *WatchEndpointSlicesOptions) cache.SharedIndexInformer
+}
+
+// EndpointSliceResource is the resource of EndpointSlices. EndpointSlices are
+// not available in the client-go version in use, so they are watched as
+// unstructured objects.
+var EndpointSliceResource = schema.GroupVersionResource{
+	Group:    "discovery.k8s.io",
+	Version:  "v1",
+	Resource: "endpointslices",
 }
 
 type WatchOptions struct {
@@ -37,9 +52,31 @@ type WatchServiceOptions struct {
 	WatchOptions
 }
 
+type ListNodesOptions struct{}
+
+type WatchNodesOptions struct {
+	ListNodesOptions
+	WatchOptions
+}
+
+type ListPodsOptions struct{}
+
+type WatchPodsOptions struct {
+	ListPodsOptions
+	WatchOptions
+}
+
+type ListEndpointSlicesOptions struct{}
+
+type WatchEndpointSlicesOptions struct {
+	ListEndpointSlicesOptions
+	WatchOptions
+}
+
 type client struct {
-	config *config.KubernetesConfig
-	client kubernetes.Interface
+	config  *config.KubernetesConfig
+	client  kubernetes.Interface
+	dynamic dynamic.Interface
 }
 
 func NewClient(conf *config.KubernetesConfig) (Client, error) {
@@ -55,9 +92,16 @@ func NewClient(conf *config.KubernetesConfig) (Client, error) {
 		return nil, merry.Wrap(err)
 	}
 
+	dynamicClient, err := dynamic.NewForConfig(restConf)
+
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
 	return &client{
-		config: conf,
-		client: kubeClient,
+		config:  conf,
+		client:  kubeClient,
+		dynamic: dynamicClient,
 	}, nil
 }
 
@@ -68,3 +112,17 @@ func (c *client) WatchEndpoints(ctx context.Context, opts *WatchEndpointsOptions
 func (c *client) WatchService(ctx context.Context, opts *WatchServiceOptions) cache.SharedIndexInformer {
 	return corev1.NewServiceInformer(c.client, c.config.Namespace, opts.ResyncPeriod, cache.Indexers{})
 }
+
+// WatchNodes watches nodes in all namespaces because nodes are not namespaced.
+func (c *client) WatchNodes(ctx context.Context, opts *WatchNodesOptions) cache.SharedIndexInformer {
+	return corev1.NewNodeInformer(c.client, opts.ResyncPeriod, cache.Indexers{})
+}
+
+func (c *client) WatchPods(ctx context.Context, opts *WatchPodsOptions) cache.SharedIndexInformer {
+	return corev1.NewPodInformer(c.client, c.config.Namespace, opts.ResyncPeriod, cache.Indexers{})
+}
+
+// WatchEndpointSlices watches EndpointSlices as *unstructured.Unstructured.
+func (c *client) WatchEndpointSlices(ctx context.Context, opts *WatchEndpointSlicesOptions) cache.SharedIndexInformer {
+	return dynamicinformer.NewFilteredDynamicInformer(c.dynamic, EndpointSliceResource, c.config.Namespace, opts.ResyncPeriod, cache.Indexers{}, nil).Informer()
+}
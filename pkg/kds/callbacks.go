@@ -13,14 +13,16 @@ func (s *Server) OnStreamOpen(context.Context, int64, string) error {
 func (s *Server) OnStreamClosed(int64) {
 }
 
-func (s *Server) OnStreamRequest(int64, *api.DiscoveryRequest) error {
+func (s *Server) OnStreamRequest(_ int64, req *api.DiscoveryRequest) error {
+	s.addNodeLocality(req.Node)
 	return nil
 }
 
 func (s *Server) OnStreamResponse(int64, *api.DiscoveryRequest, *api.DiscoveryResponse) {
 }
 
-func (s *Server) OnFetchRequest(context.Context, *api.DiscoveryRequest) error {
+func (s *Server) OnFetchRequest(_ context.Context, req *api.DiscoveryRequest) error {
+	s.addNodeLocality(req.Node)
 	return nil
 }
 
@@ -0,0 +1,56 @@
+package kds
+
+import (
+	"sort"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/tommy351/kubenvoy/pkg/envoy"
+)
+
+type nodeGroup struct {
+	Key      string
+	Locality *core.Locality
+}
+
+// addNodeLocality records the locality of an Envoy, so snapshots are built for
+// its zone on the next update.
+func (s *Server) addNodeLocality(node *core.Node) {
+	if !s.Config.Envoy.Locality.Enabled || node == nil || node.Id != s.Config.Envoy.Node {
+		return
+	}
+
+	key := envoy.NodeGroup(node.Id, node.Locality)
+
+	if key == node.Id {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.localities == nil {
+		s.localities = map[string]*core.Locality{}
+	}
+
+	s.localities[key] = node.Locality
+}
+
+// getNodeGroups returns groups of Envoys sorted by keys. Envoys which don't
+// report their zones are always in the first group.
+func (s *Server) getNodeGroups() []nodeGroup {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	node := s.Config.Envoy.Node
+	result := []nodeGroup{{Key: node}}
+
+	for key, locality := range s.localities {
+		result = append(result, nodeGroup{Key: key, Locality: locality})
+	}
+
+	sort.Slice(result[1:], func(i, j int) bool {
+		return result[i+1].Key < result[j+1].Key
+	})
+
+	return result
+}
@@ -3,9 +3,11 @@ package kds
 import (
 	"context"
 	"net"
+	"sync"
 
 	"github.com/ansel1/merry"
 	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
 	xds "github.com/envoyproxy/go-control-plane/pkg/server"
 	"github.com/rs/zerolog"
@@ -18,6 +20,10 @@ import (
 type Server struct {
 	Config           *config.Config
 	KubernetesClient k8s.Client
+
+	mutex      sync.RWMutex
+	localities map[string]*core.Locality
+	drain      *envoy.DrainTracker
 }
 
 func (s *Server) Serve(ctx context.Context) (err error) {
@@ -28,7 +34,9 @@ func (s *Server) Serve(ctx context.Context) (err error) {
 		return merry.Wrap(err)
 	}
 
-	sc := envoy.NewCache(ctx)
+	sc := envoy.NewCache(ctx, envoy.NodeHash{
+		Localities: s.Config.Envoy.Locality.Enabled,
+	})
 
 	if err := s.BuildSnapshot(ctx, sc); err != nil {
 		return merry.Wrap(err)
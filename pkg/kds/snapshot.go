@@ -2,6 +2,7 @@ package kds
 
 import (
 	"context"
+	"strconv"
 	"time"
 
 	"github.com/ansel1/merry"
@@ -11,18 +12,54 @@ import (
 	"k8s.io/client-go/tools/cache"
 )
 
+// informers contains informers snapshots are built from. Only one of
+// Endpoints and EndpointSlices is watched. Nodes and pods are nil when they
+// are not watched.
+type informers struct {
+	Services       cache.SharedIndexInformer
+	Endpoints      cache.SharedIndexInformer
+	EndpointSlices cache.SharedIndexInformer
+	Nodes          cache.SharedIndexInformer
+	Pods           cache.SharedIndexInformer
+}
+
 func (s *Server) BuildSnapshot(ctx context.Context, sc *envoy.Cache) error {
 	logger := zerolog.Ctx(ctx)
 	watchOpts := k8s.WatchOptions{ResyncPeriod: s.Config.Kubernetes.ResyncPeriod}
-	svcInformer := s.KubernetesClient.WatchService(ctx, &k8s.WatchServiceOptions{WatchOptions: watchOpts})
-	epInformer := s.KubernetesClient.WatchEndpoints(ctx, &k8s.WatchEndpointsOptions{WatchOptions: watchOpts})
+	inf := &informers{
+		Services: s.KubernetesClient.WatchService(ctx, &k8s.WatchServiceOptions{WatchOptions: watchOpts}),
+	}
 
 	// Start the informer
-	runInformer(ctx, svcInformer)
-	runInformer(ctx, epInformer)
+	runInformer(ctx, inf.Services)
+
+	if s.Config.Kubernetes.EndpointSlices {
+		inf.EndpointSlices = s.KubernetesClient.WatchEndpointSlices(ctx, &k8s.WatchEndpointSlicesOptions{WatchOptions: watchOpts})
+		runInformer(ctx, inf.EndpointSlices)
+	} else {
+		inf.Endpoints = s.KubernetesClient.WatchEndpoints(ctx, &k8s.WatchEndpointsOptions{WatchOptions: watchOpts})
+		runInformer(ctx, inf.Endpoints)
+	}
+
+	// Nodes are only watched when localities are enabled because it requires
+	// permissions of cluster-scoped resources.
+	if s.Config.Envoy.Locality.Enabled {
+		inf.Nodes = s.KubernetesClient.WatchNodes(ctx, &k8s.WatchNodesOptions{WatchOptions: watchOpts})
+		runInformer(ctx, inf.Nodes)
+	}
+
+	// Pods are only watched when weights or labels of pods are used.
+	if s.Config.Envoy.Weights.Enabled || s.Config.Envoy.Subsets.Enabled {
+		inf.Pods = s.KubernetesClient.WatchPods(ctx, &k8s.WatchPodsOptions{WatchOptions: watchOpts})
+		runInformer(ctx, inf.Pods)
+	}
+
+	if gracePeriod := s.Config.Envoy.Draining.GracePeriod; gracePeriod > 0 {
+		s.drain = envoy.NewDrainTracker(gracePeriod)
+	}
 
 	// Set initial snapshot
-	if err := s.setSnapshot(ctx, sc, svcInformer, epInformer); err != nil {
+	if err := s.setSnapshot(ctx, sc, inf); err != nil {
 		return merry.Wrap(err)
 	}
 
@@ -36,7 +73,7 @@ func (s *Server) BuildSnapshot(ctx context.Context, sc *envoy.Cache) error {
 				return
 
 			case <-ticker.C:
-				if err := s.setSnapshot(ctx, sc, svcInformer, epInformer); err != nil {
+				if err := s.setSnapshot(ctx, sc, inf); err != nil {
 					logger.Error().Stack().Err(err).Msg("Failed to set the snapshot")
 				}
 			}
@@ -61,34 +98,96 @@ func runInformer(ctx context.Context, informer cache.SharedIndexInformer) {
 	}
 }
 
-func (s *Server) setSnapshot(ctx context.Context, sc *envoy.Cache, svcInformer, epInformer cache.SharedIndexInformer) error {
-	version := epInformer.LastSyncResourceVersion()
-
-	if !sc.ShouldUpdate(version) {
+func getStore(informer cache.SharedIndexInformer) cache.Store {
+	if informer == nil {
 		return nil
 	}
 
+	return informer.GetStore()
+}
+
+func (s *Server) setSnapshot(ctx context.Context, sc *envoy.Cache, inf *informers) error {
 	logger := zerolog.Ctx(ctx)
-	node := s.Config.Envoy.Node
+	options := envoy.SnapshotOptions{
+		Endpoints:      getStore(inf.Endpoints),
+		EndpointSlices: getStore(inf.EndpointSlices),
+		Services:       inf.Services.GetStore(),
+		Nodes:          getStore(inf.Nodes),
+		Pods:           getStore(inf.Pods),
+		Config:         &s.Config.Envoy,
+		Logger:         logger,
+		Time:           time.Now(),
+	}
+
+	// Services are included in the version, so changes of annotations are
+	// applied without changes of endpoints. Nodes are excluded because their
+	// status is updated constantly, and labels of nodes are read when endpoints
+	// change.
+	version := inf.Services.LastSyncResourceVersion()
+
+	if inf.EndpointSlices != nil {
+		version += "-" + inf.EndpointSlices.LastSyncResourceVersion()
+	} else {
+		version += "-" + inf.Endpoints.LastSyncResourceVersion()
+	}
 
-	snapshot, err := envoy.NewSnapshot(&envoy.SnapshotOptions{
-		Version:   version,
-		Endpoints: epInformer.GetStore(),
-		Services:  svcInformer.GetStore(),
-	})
+	if inf.Pods != nil {
+		version += "-" + inf.Pods.LastSyncResourceVersion()
+	}
+
+	// Draining addresses are removed from snapshots after the grace period
+	// without changes of endpoints.
+	if s.drain != nil {
+		s.drain.Expire(options.Time)
+		version += "-" + strconv.FormatUint(s.drain.Generation(), 10)
+	}
+
+	// Weights of pods in slow start are increased over time, so snapshots are
+	// rebuilt whenever any of the weights changes until slow start ends.
+	weights, err := envoy.SlowStartVersion(&options)
 
 	if err != nil {
 		return merry.Wrap(err)
 	}
 
-	if err := sc.UpdateSnapshot(node, version, *snapshot); err != nil {
-		return merry.Wrap(err)
+	if weights != "" {
+		version += "-" + weights
+	}
+
+	options.Version = version
+
+	// The drain tracker is updated once for all node groups, so addresses are
+	// drained and removed at the same time in all snapshots.
+	if s.drain != nil {
+		if options.Drains, err = s.drain.Update(&options); err != nil {
+			return merry.Wrap(err)
+		}
 	}
 
-	logger.Debug().
-		Str("node", node).
-		Str("version", version).
-		Msg("Set snapshot")
+	// Each group of Envoys has its own snapshot because endpoints can be
+	// prioritized by zones of Envoys.
+	for _, group := range s.getNodeGroups() {
+		if !sc.ShouldUpdate(group.Key, version) {
+			continue
+		}
+
+		groupOptions := options
+		groupOptions.Locality = group.Locality
+		snapshot, err := envoy.NewSnapshot(&groupOptions)
+
+		if err != nil {
+			return merry.Wrap(err)
+		}
+
+		if err := sc.UpdateSnapshot(group.Key, version, *snapshot); err != nil {
+			return merry.Wrap(err)
+		}
+
+		logger.Debug().
+			Str("node", group.Key).
+			Str("version", version).
+			Msg("Set snapshot")
+	}
 
 	return nil
 }
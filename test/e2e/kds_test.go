@@ -2,11 +2,13 @@ package e2e
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/tommy351/kubenvoy/test/echo"
+	"golang.org/x/net/websocket"
 )
 
 func decodeResponse(r *http.Response) (*echo.Response, error) {
@@ -77,3 +79,30 @@ var _ = Describe("kds", func() {
 		})
 	})
 })
+
+var _ = Describe("kds websocket", func() {
+	var ws *websocket.Conn
+
+	BeforeEach(func() {
+		conf, err := websocket.NewConfig("ws://websocket.echo/", "http://localhost/")
+		Expect(err).NotTo(HaveOccurred())
+
+		conn, err := net.Dial("tcp", "localhost:10000")
+		Expect(err).NotTo(HaveOccurred())
+
+		ws, err = websocket.NewClient(conf, conn)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(ws.Close()).To(Succeed())
+	})
+
+	It("should echo messages", func() {
+		var msg string
+
+		Expect(websocket.Message.Send(ws, "hello")).To(Succeed())
+		Expect(websocket.Message.Receive(ws, &msg)).To(Succeed())
+		Expect(msg).To(Equal("hello"))
+	})
+})
@@ -2,13 +2,22 @@ package echo
 
 import (
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
 )
 
 type Handler struct{}
 
 func (*Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		websocket.Handler(echoWebSocket).ServeHTTP(w, r)
+		return
+	}
+
 	body, _ := ioutil.ReadAll(r.Body)
 	res := Response{
 		Method: r.Method,
@@ -25,3 +34,7 @@ func (*Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 }
+
+func echoWebSocket(ws *websocket.Conn) {
+	_, _ = io.Copy(ws, ws)
+}